@@ -0,0 +1,52 @@
+package near
+
+import (
+	"github.com/miekg/dns"
+)
+
+// zoneApex is the apex of the zone served by the plugin.  Every NEAR account
+// is a name in the zone, unless it is delegated.
+const zoneApex = "near."
+
+// handleApex answers queries for the zone apex from the configuration,
+// without reading the contract.
+func (n NEAR) handleApex(name string, qtype uint16) ([]dns.RR, error) {
+	results := make([]dns.RR, 0)
+	if name != zoneApex {
+		return results, nil
+	}
+
+	switch qtype {
+	case dns.TypeSOA:
+		return n.handleSOA(name, zoneApex, nil)
+	case dns.TypeNS:
+		return n.handleNS(name, zoneApex, nil)
+	case dns.TypeA:
+		for _, ip := range parseIPs(n.ApexAs) {
+			results = append(results, &dns.A{Hdr: n.apexHeader(qtype), A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range parseIPs(n.ApexAAAAs) {
+			results = append(results, &dns.AAAA{Hdr: n.apexHeader(qtype), AAAA: ip})
+		}
+	case dns.TypeTXT:
+		for _, txt := range n.ApexTXTs {
+			results = append(results, &dns.TXT{Hdr: n.apexHeader(qtype), Txt: []string{txt}})
+		}
+	case dns.TypeDNSKEY:
+		if n.DNSSEC != nil {
+			results = n.DNSSEC.DNSKEYs(zoneApex, n.synthesizedTTL(qtype, false))
+		}
+	}
+	return results, nil
+}
+
+// apexHeader returns the header of a configured apex record.
+func (n NEAR) apexHeader(qtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   zoneApex,
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    n.synthesizedTTL(qtype, false),
+	}
+}
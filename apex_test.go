@@ -0,0 +1,59 @@
+package near
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestLookupApex(t *testing.T) {
+	n := NEAR{
+		NEARLinkNameServers: []string{"ns1.neardns.xyz", "ns2.neardns.xyz"},
+		ApexAs:              []string{"192.0.2.1"},
+		ApexAAAAs:           []string{"2001:db8::1"},
+		ApexTXTs:            []string{"v=spf1 -all"},
+	}
+	soa := "near. 300 IN SOA ns1.neardns.xyz. hostmaster.near. 1 3600 600 1209600 300"
+
+	tests := []struct {
+		qname     string
+		qtype     uint16
+		result    Result
+		answer    []string
+		authority []string
+	}{
+		{"near.", dns.TypeSOA, Success, []string{"near. 10800 IN SOA ns1.neardns.xyz. hostmaster.near. 1 3600 600 1209600 300"}, nil},
+		{"near.", dns.TypeNS, Success, []string{"near. 3600 IN NS ns1.neardns.xyz.", "near. 3600 IN NS ns2.neardns.xyz."}, nil},
+		{"near.", dns.TypeA, Success, []string{"near. 3600 IN A 192.0.2.1"}, nil},
+		{"near.", dns.TypeAAAA, Success, []string{"near. 3600 IN AAAA 2001:db8::1"}, nil},
+		{"near.", dns.TypeTXT, Success, []string{`near. 3600 IN TXT "v=spf1 -all"`}, nil},
+		{"near.", dns.TypeMX, NoData, nil, []string{soa}},
+		{"*.near.", dns.TypeA, NameError, nil, []string{soa}},
+		{"_dmarc.near.", dns.TypeTXT, NameError, nil, []string{soa}},
+	}
+	for i, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		state := request.Request{W: &test.ResponseWriter{}, Req: r}
+		answer, authority, _, result := Lookup(n, state)
+		if result != tt.result {
+			t.Errorf("Test %d: result %d (expected %d)", i, result, tt.result)
+		}
+		if len(answer) != len(tt.answer) || len(authority) != len(tt.authority) {
+			t.Errorf("Test %d: got %v %v (expected %v %v)", i, answer, authority, tt.answer, tt.authority)
+			continue
+		}
+		for j := range answer {
+			if answer[j].String() != newRR(tt.answer[j]).String() {
+				t.Errorf("Test %d: answer %v (expected %v)", i, answer[j], tt.answer[j])
+			}
+		}
+		for j := range authority {
+			if authority[j].String() != newRR(tt.authority[j]).String() {
+				t.Errorf("Test %d: authority %v (expected %v)", i, authority[j], tt.authority[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package near
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Multicodec values for EIP-1577 content hash namespaces and CIDs.
+const (
+	codecIPFSNamespace = 0xe3
+	codecIPNSNamespace = 0xe5
+	codecDagPB         = 0x70
+	cidVersion1        = 0x01
+	multihashSHA256    = 0x12
+)
+
+// maxLabelLength is the maximum length of a DNS label, which CIDs used as
+// labels of subdomain gateways must fit in.
+const maxLabelLength = 63
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var lowerBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// ContentHash is a decoded content hash: the namespace the content lives in
+// ("ipfs" or "ipns") and the binary CIDv1 of the content.
+type ContentHash struct {
+	Namespace string
+	CID       []byte
+}
+
+// String returns the content hash CID as a lowercase base32 multibase string,
+// which is suitable for use as a DNS label.
+func (c ContentHash) String() string {
+	return "b" + lowerBase32.EncodeToString(c.CID)
+}
+
+// decodeContentHash decodes a content hash as stored in the contract.  It
+// accepts EIP-1577 hex encoding (with or without a 0x prefix), plain CIDs
+// and IPFS paths or URLs such as /ipfs/<cid> and ipfs://<cid>.
+func decodeContentHash(contentHash []byte) (*ContentHash, error) {
+	value := strings.TrimSpace(string(contentHash))
+	if value == "" {
+		return nil, errors.New("empty content hash")
+	}
+
+	namespace := "ipfs"
+	for _, ns := range []string{"ipfs", "ipns"} {
+		if strings.HasPrefix(value, ns+"://") || strings.HasPrefix(value, "/"+ns+"/") {
+			namespace = ns
+			value = strings.TrimPrefix(strings.TrimPrefix(value, ns+"://"), "/"+ns+"/")
+			value = strings.SplitN(value, "/", 2)[0]
+			break
+		}
+	}
+
+	if bin, err := hex.DecodeString(strings.TrimPrefix(value, "0x")); err == nil && len(bin) > 2 {
+		return decodeEIP1577(bin)
+	}
+
+	cid, err := parseCID(value)
+	if err != nil {
+		return nil, err
+	}
+	return &ContentHash{Namespace: namespace, CID: cid}, nil
+}
+
+// decodeEIP1577 decodes a binary EIP-1577 content hash.
+func decodeEIP1577(bin []byte) (*ContentHash, error) {
+	codec, n := binary.Uvarint(bin)
+	if n <= 0 {
+		return nil, errors.New("invalid content hash namespace")
+	}
+	var namespace string
+	switch codec {
+	case codecIPFSNamespace:
+		namespace = "ipfs"
+	case codecIPNSNamespace:
+		namespace = "ipns"
+	default:
+		return nil, fmt.Errorf("unsupported content hash namespace 0x%x", codec)
+	}
+	cid := bin[n:]
+	if len(cid) == 0 || cid[0] != cidVersion1 {
+		// A CIDv0 is a bare multihash
+		cid = append([]byte{cidVersion1, codecDagPB}, cid...)
+	}
+	return &ContentHash{Namespace: namespace, CID: cid}, nil
+}
+
+// parseCID parses a textual CID into a binary CIDv1.
+func parseCID(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "Qm") && len(value) == 46:
+		// CIDv0: base58btc SHA-256 multihash
+		multihash, err := decodeBase58(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(multihash) != 34 || multihash[0] != multihashSHA256 {
+			return nil, errors.New("invalid CIDv0")
+		}
+		return append([]byte{cidVersion1, codecDagPB}, multihash...), nil
+	case strings.HasPrefix(value, "b"):
+		cid, err := lowerBase32.DecodeString(strings.ToLower(value[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CID: %v", err)
+		}
+		if len(cid) == 0 || cid[0] != cidVersion1 {
+			return nil, errors.New("invalid CIDv1")
+		}
+		return cid, nil
+	case strings.HasPrefix(value, "z"):
+		cid, err := decodeBase58(value[1:])
+		if err != nil {
+			return nil, err
+		}
+		if len(cid) == 0 || cid[0] != cidVersion1 {
+			return nil, errors.New("invalid CIDv1")
+		}
+		return cid, nil
+	}
+	return nil, fmt.Errorf("unsupported CID %q", value)
+}
+
+func decodeBase58(value string) ([]byte, error) {
+	result := big.NewInt(0)
+	radix := big.NewInt(58)
+	for _, c := range value {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		result.Mul(result, radix)
+		result.Add(result, big.NewInt(int64(digit)))
+	}
+	decoded := result.Bytes()
+	// Leading '1's are leading zero bytes
+	zeros := 0
+	for zeros < len(value) && value[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), decoded...), nil
+}
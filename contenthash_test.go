@@ -0,0 +1,43 @@
+package near
+
+import (
+	"testing"
+)
+
+func TestDecodeContentHash(t *testing.T) {
+	const cidv1 = "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4"
+	tests := []struct {
+		contentHash string
+		namespace   string
+		cid         string
+		err         bool
+	}{
+		{"0xe3010170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f", "ipfs", cidv1, false},
+		{"e30101701220" + "29f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f", "ipfs", cidv1, false},
+		{"QmRAQB6YaCyidP37UdDnjFY5vQuiBrcqdyoW1CuDgwxkD4", "ipfs", cidv1, false},
+		{"ipfs://QmRAQB6YaCyidP37UdDnjFY5vQuiBrcqdyoW1CuDgwxkD4", "ipfs", cidv1, false},
+		{"/ipfs/" + cidv1 + "/index.html", "ipfs", cidv1, false},
+		{"/ipns/" + cidv1, "ipns", cidv1, false},
+		{"0xe5010170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f", "ipns", cidv1, false},
+		{"0xe4010170", "", "", true},
+		{"", "", "", true},
+		{"not a hash", "", "", true},
+	}
+
+	for i, tt := range tests {
+		hash, err := decodeContentHash([]byte(tt.contentHash))
+		if tt.err {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got %v", i, hash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if hash.Namespace != tt.namespace || hash.String() != tt.cid {
+			t.Errorf("Test %d: got %s %s (expected %s %s)", i, hash.Namespace, hash, tt.namespace, tt.cid)
+		}
+	}
+}
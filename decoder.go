@@ -0,0 +1,136 @@
+package near
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResultDecoder decodes the return value of a contract view call into the
+// payload it carries.  field names the member of a JSON object that holds
+// the payload, if the decoder uses one.
+type ResultDecoder interface {
+	Decode(result []byte, field string) ([]byte, error)
+}
+
+// ResultDecoderFunc adapts a function to a ResultDecoder.
+type ResultDecoderFunc func(result []byte, field string) ([]byte, error)
+
+// Decode implements ResultDecoder.
+func (f ResultDecoderFunc) Decode(result []byte, field string) ([]byte, error) {
+	return f(result, field)
+}
+
+// resultDecoders are the available result decoders, by encoding.
+var resultDecoders = map[string]ResultDecoder{
+	"json":   ResultDecoderFunc(decodeJSONString),
+	"object": ResultDecoderFunc(decodeJSONObject),
+	"base64": ResultDecoderFunc(decodeBase64),
+	"borsh":  ResultDecoderFunc(decodeBorsh),
+	"raw":    ResultDecoderFunc(decodeRaw),
+}
+
+// RegisterResultDecoder makes a result decoder available for use in
+// contract profiles.
+func RegisterResultDecoder(encoding string, decoder ResultDecoder) {
+	resultDecoders[strings.ToLower(encoding)] = decoder
+}
+
+// resultDecoder returns the decoder for an encoding.
+func resultDecoder(encoding string) (ResultDecoder, error) {
+	decoder, exists := resultDecoders[strings.ToLower(encoding)]
+	if !exists {
+		return nil, fmt.Errorf("unknown result encoding %q", encoding)
+	}
+	return decoder, nil
+}
+
+// decodeJSONString decodes a JSON string.  A JSON null is an empty payload.
+func decodeJSONString(result []byte, field string) ([]byte, error) {
+	result = bytes.TrimSpace(result)
+	if len(result) == 0 || string(result) == "null" {
+		return []byte{}, nil
+	}
+	var value string
+	if err := json.Unmarshal(result, &value); err != nil {
+		return nil, fmt.Errorf("result is not a JSON string: %v", err)
+	}
+	return []byte(value), nil
+}
+
+// decodeJSONObject decodes a JSON value.  If field is set and the value is
+// an object the member named field is used; a string member is returned as
+// its content and any other member as JSON.  Without a field the JSON itself
+// is returned, which suits the JSON record schema.
+func decodeJSONObject(result []byte, field string) ([]byte, error) {
+	result = bytes.TrimSpace(result)
+	if len(result) == 0 || string(result) == "null" {
+		return []byte{}, nil
+	}
+	if !json.Valid(result) {
+		return nil, errors.New("result is not valid JSON")
+	}
+	if field == "" {
+		return result, nil
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(result, &object); err != nil {
+		return nil, fmt.Errorf("result is not a JSON object: %v", err)
+	}
+	member, exists := object[field]
+	if !exists {
+		return []byte{}, nil
+	}
+	var value string
+	if err := json.Unmarshal(member, &value); err == nil {
+		return []byte(value), nil
+	}
+	if string(bytes.TrimSpace(member)) == "null" {
+		return []byte{}, nil
+	}
+	return member, nil
+}
+
+// decodeBase64 decodes a JSON string holding base64 data.
+func decodeBase64(result []byte, field string) ([]byte, error) {
+	value, err := decodeJSONObject(result, field)
+	if err != nil {
+		return nil, err
+	}
+	if field == "" {
+		if value, err = decodeJSONString(value, ""); err != nil {
+			return nil, err
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(value))
+	if err != nil {
+		return nil, fmt.Errorf("result is not base64: %v", err)
+	}
+	return decoded, nil
+}
+
+// decodeBorsh decodes a Borsh-serialised Vec<u8>, String or Option of
+// either: a little-endian u32 length followed by the data, optionally
+// preceded by a 0 (None) or 1 (Some) byte.
+func decodeBorsh(result []byte, field string) ([]byte, error) {
+	if len(result) >= 4 && uint64(binary.LittleEndian.Uint32(result))+4 == uint64(len(result)) {
+		return result[4:], nil
+	}
+	if len(result) == 1 && result[0] == 0 {
+		return []byte{}, nil
+	}
+	if len(result) >= 5 && result[0] == 1 && uint64(binary.LittleEndian.Uint32(result[1:]))+5 == uint64(len(result)) {
+		return result[5:], nil
+	}
+	return nil, fmt.Errorf("result is not a Borsh byte vector (%d bytes)", len(result))
+}
+
+// decodeRaw returns the result as is.
+func decodeRaw(result []byte, field string) ([]byte, error) {
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package near
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResultDecoders(t *testing.T) {
+	tests := []struct {
+		encoding string
+		field    string
+		result   []byte
+		payload  []byte
+		err      bool
+	}{
+		{"json", "", []byte(`"0xe301"`), []byte("0xe301"), false},
+		{"json", "", []byte(`"say \"hi\""`), []byte(`say "hi"`), false},
+		{"json", "", []byte(`null`), []byte{}, false},
+		{"json", "", []byte(`{"a": 1}`), nil, true},
+		{"object", "", []byte(`[{"type": "A", "value": "192.0.2.1"}]`), []byte(`[{"type": "A", "value": "192.0.2.1"}]`), false},
+		{"object", "content_hash", []byte(`{"content_hash": "Qm"}`), []byte("Qm"), false},
+		{"object", "records", []byte(`{"records": [1]}`), []byte(`[1]`), false},
+		{"object", "records", []byte(`{"other": 1}`), []byte{}, false},
+		{"object", "", []byte(`{"a":`), nil, true},
+		{"base64", "", []byte(`"aGVsbG8="`), []byte("hello"), false},
+		{"base64", "data", []byte(`{"data": "aGVsbG8="}`), []byte("hello"), false},
+		{"base64", "", []byte(`"not base64!"`), nil, true},
+		{"borsh", "", []byte{5, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}, []byte("hello"), false},
+		{"borsh", "", []byte{1, 2, 0, 0, 0, 'h', 'i'}, []byte("hi"), false},
+		{"borsh", "", []byte{0}, []byte{}, false},
+		{"borsh", "", []byte{9, 0, 0, 0, 'h'}, nil, true},
+		{"raw", "", []byte{0, 1, 2}, []byte{0, 1, 2}, false},
+	}
+
+	for i, tt := range tests {
+		decoder, err := resultDecoder(tt.encoding)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		payload, err := decoder.Decode(tt.result, tt.field)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got %q", i, payload)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if !bytes.Equal(payload, tt.payload) {
+			t.Errorf("Test %d: got %q (expected %q)", i, payload, tt.payload)
+		}
+	}
+
+	if _, err := resultDecoder("unknown"); err == nil {
+		t.Errorf("Expected error for unknown encoding")
+	}
+}
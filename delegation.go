@@ -0,0 +1,121 @@
+package near
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultDelegationMaxAge is how long the delegation of an account is
+	// cached by default.
+	defaultDelegationMaxAge = time.Minute
+	// delegationCacheSize is the number of accounts whose delegation is
+	// cached.
+	delegationCacheSize = 10000
+)
+
+// DelegationCache caches the NS record sets that accounts publish, including
+// the absence of one, so that the accounts above a name are not read from
+// the contract on every query.
+type DelegationCache struct {
+	// MaxAge is how long the record set of an account is cached.
+	MaxAge time.Duration
+
+	cache *cache.Cache
+}
+
+// cachedDelegation is the cached NS record set of an account.
+type cachedDelegation struct {
+	rrSet   []byte
+	fetched time.Time
+}
+
+// NewDelegationCache creates a delegation cache.
+func NewDelegationCache(maxAge time.Duration) *DelegationCache {
+	return &DelegationCache{MaxAge: maxAge, cache: cache.New(delegationCacheSize)}
+}
+
+// get returns the cached NS record set of an account, if it is cached and
+// not older than MaxAge.
+func (c *DelegationCache) get(account string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	cached, ok := c.cache.Get(cache.Hash([]byte(account)))
+	if !ok {
+		return nil, false
+	}
+	delegation := cached.(cachedDelegation)
+	if time.Since(delegation.fetched) >= c.MaxAge {
+		return nil, false
+	}
+	return delegation.rrSet, true
+}
+
+// add caches the NS record set of an account.
+func (c *DelegationCache) add(account string, rrSet []byte) {
+	if c == nil {
+		return
+	}
+	c.cache.Add(cache.Hash([]byte(account)), cachedDelegation{rrSet: rrSet, fetched: time.Now()})
+}
+
+// Delegation implements the Delegator interface.  An account is delegated
+// to its own nameservers by publishing NS records, and optionally DS
+// records, in the contract; the delegation covers the account and every
+// name below it.  Accounts are checked from the top down so that the
+// highest delegation wins.  Failures to read the contract are returned, as
+// a delegated name must not be answered from here.
+func (n NEAR) Delegation(domain string, name string, do bool) ([]dns.RR, []dns.RR, error) {
+	if !validAccount(domain) || n.isNameServer(name) {
+		return nil, nil, nil
+	}
+	for _, account := range parentAccounts(domain) {
+		nsRrs, err := n.delegationRRs(account)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(nsRrs) == 0 {
+			continue
+		}
+		dsRrs, err := n.handleDS(account, account)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nsRrs, dsRrs, nil
+	}
+	return nil, nil, nil
+}
+
+// delegationRRs reads the NS records that the account publishes at its own
+// name, through the delegation cache.
+func (n NEAR) delegationRRs(account string) ([]dns.RR, error) {
+	rrSet, cached := n.Delegations.get(account)
+	if !cached {
+		var err error
+		rrSet, err = n.obtainRRSet(account, account, dns.TypeNS)
+		if err != nil && err != errUnsupportedKind {
+			return nil, err
+		}
+		n.Delegations.add(account, rrSet)
+	}
+	if len(rrSet) == 0 {
+		return nil, nil
+	}
+	return n.contractRRSet(account, rrSet, account, dns.TypeNS), nil
+}
+
+// parentAccounts returns the accounts from the top-level account down to the
+// account in domain, for example alice.near. and www.alice.near. for
+// www.alice.near.
+func parentAccounts(domain string) []string {
+	labels := dns.SplitDomainName(strings.TrimSuffix(domain, "."+zoneApex))
+	accounts := make([]string, len(labels))
+	for i := range labels {
+		accounts[i] = strings.Join(labels[len(labels)-1-i:], ".") + "." + zoneApex
+	}
+	return accounts
+}
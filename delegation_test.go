@@ -0,0 +1,215 @@
+package near
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	nearclient "github.com/CrossChainLabs/near-api-go"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// delegatingServer is a mock server that delegates names with NS records
+// below the zone apex.
+type delegatingServer struct {
+	MockServer
+}
+
+func (d delegatingServer) Delegation(zone string, name string, do bool) ([]dns.RR, []dns.RR, error) {
+	for cut := name; cut != zone && dns.IsSubDomain(zone, cut); {
+		nsRrs, err := d.Query(zone, cut, dns.TypeNS, do)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(nsRrs) > 0 {
+			dsRrs, err := d.Query(zone, cut, dns.TypeDS, do)
+			return nsRrs, dsRrs, err
+		}
+		i, end := dns.NextLabel(cut, 0)
+		if end {
+			break
+		}
+		cut = cut[i:]
+	}
+	return nil, nil, nil
+}
+
+var delegationServer = delegatingServer{MockServer{
+	zones: []Zone{
+		{name: "example.com.", records: []Record{
+			{"example.com.", dns.ClassINET, dns.TypeSOA, "example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2 19762 1800 1814400 14400"},
+			{"sub.example.com.", dns.ClassINET, dns.TypeNS, "sub.example.com. 3600 IN NS ns1.sub.example.com."},
+			{"sub.example.com.", dns.ClassINET, dns.TypeNS, "sub.example.com. 3600 IN NS ns.example.org."},
+			{"sub.example.com.", dns.ClassINET, dns.TypeDS, "sub.example.com. 3600 IN DS 12345 13 2 2bb183af5f22588179a53b0a98631fad1a292118"},
+			{"ns1.sub.example.com.", dns.ClassINET, dns.TypeA, "ns1.sub.example.com. 3600 IN A 1.1.3.1"},
+		}},
+	},
+}}
+
+func TestLookupDelegation(t *testing.T) {
+	tests := []struct {
+		qname      string
+		qtype      uint16
+		do         bool
+		result     Result
+		answer     int
+		authority  int
+		additional int
+	}{
+		{"sub.example.com.", dns.TypeA, false, Delegation, 0, 2, 1},
+		{"www.sub.example.com.", dns.TypeMX, false, Delegation, 0, 2, 1},
+		{"www.sub.example.com.", dns.TypeMX, true, Delegation, 0, 3, 1},
+		{"sub.example.com.", dns.TypeNS, false, Delegation, 0, 2, 1},
+		{"sub.example.com.", dns.TypeDS, false, Success, 1, 0, 0},
+		{"example.com.", dns.TypeSOA, false, Success, 1, 0, 0},
+	}
+	for i, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		r.SetEdns0(4096, tt.do)
+		state := request.Request{W: &test.ResponseWriter{}, Req: r}
+		answer, authority, additional, result := Lookup(delegationServer, state)
+		if result != tt.result {
+			t.Errorf("Test %d: result %d (expected %d)", i, result, tt.result)
+		}
+		if len(answer) != tt.answer || len(authority) != tt.authority || len(additional) != tt.additional {
+			t.Errorf("Test %d: got %v %v %v", i, answer, authority, additional)
+		}
+	}
+}
+
+func TestNEARDelegation(t *testing.T) {
+	n := indexedNEAR(t, map[string]string{
+		"alice:contenthash": testContentHash,
+		"bob:NS":            "@ 300 IN NS ns1.example.org.\n@ 300 IN NS ns2.example.org.",
+		"bob:DS":            "@ 300 IN DS 12345 13 2 2bb183af5f22588179a53b0a98631fad1a292118a0f7c5fbd7ab3e2b2a3e5f8e",
+		"www.bob:NS":        "@ 300 IN NS ns.example.net.",
+	})
+	n.Delegations = NewDelegationCache(time.Hour)
+
+	tests := []struct {
+		domain string
+		name   string
+		ns     int
+		ds     int
+	}{
+		{"alice.near.", "alice.near.", 0, 0},
+		{"www.alice.near.", "www.alice.near.", 0, 0},
+		{"bob.near.", "bob.near.", 2, 1},
+		{"bob.near.", "_dmarc.bob.near.", 2, 1},
+		// The highest delegation wins
+		{"www.bob.near.", "www.bob.near.", 2, 1},
+		{"near.", "near.", 0, 0},
+	}
+	for i, tt := range tests {
+		nsRrs, dsRrs, err := n.Delegation(tt.domain, tt.name, true)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error %v", i, err)
+		}
+		if len(nsRrs) != tt.ns || len(dsRrs) != tt.ds {
+			t.Errorf("Test %d: %s => %v %v (expected %d NS and %d DS)", i, tt.name, nsRrs, dsRrs, tt.ns, tt.ds)
+		}
+		for _, rr := range nsRrs {
+			if rr.Header().Name != "bob.near." {
+				t.Errorf("Test %d: %s => %v (expected NS at bob.near.)", i, tt.name, rr)
+			}
+		}
+	}
+
+	// Delegations are cached, including the absence of one
+	n.StateSync.mu.Lock()
+	delete(n.StateSync.accounts, "bob.near.")
+	index(n.StateSync.accounts, stateRecord{domain: "alice.near.", qtype: dns.TypeNS, value: []byte("@ 300 IN NS ns.example.net.")})
+	n.StateSync.mu.Unlock()
+	if nsRrs, _, _ := n.Delegation("bob.near.", "bob.near.", false); len(nsRrs) != 2 {
+		t.Errorf("cached delegation of bob.near. => %v", nsRrs)
+	}
+	if nsRrs, _, _ := n.Delegation("alice.near.", "alice.near.", false); len(nsRrs) != 0 {
+		t.Errorf("cached delegation of alice.near. => %v (expected none)", nsRrs)
+	}
+	n.Delegations.MaxAge = 0
+	if nsRrs, _, _ := n.Delegation("bob.near.", "bob.near.", false); len(nsRrs) != 0 {
+		t.Errorf("expired delegation of bob.near. => %v (expected none)", nsRrs)
+	}
+	if nsRrs, _, _ := n.Delegation("alice.near.", "alice.near.", false); len(nsRrs) != 1 {
+		t.Errorf("expired delegation of alice.near. => %v", nsRrs)
+	}
+}
+
+func TestParentAccounts(t *testing.T) {
+	tests := []struct {
+		domain   string
+		accounts []string
+	}{
+		{"alice.near.", []string{"alice.near."}},
+		{"www.alice.near.", []string{"alice.near.", "www.alice.near."}},
+		{"a.b.c.near.", []string{"c.near.", "b.c.near.", "a.b.c.near."}},
+	}
+	for _, tt := range tests {
+		accounts := parentAccounts(tt.domain)
+		if len(accounts) != len(tt.accounts) {
+			t.Errorf("Failure: %v => %v (expected %v)", tt.domain, accounts, tt.accounts)
+			continue
+		}
+		for i := range accounts {
+			if accounts[i] != tt.accounts[i] {
+				t.Errorf("Failure: %v => %v (expected %v)", tt.domain, accounts, tt.accounts)
+			}
+		}
+	}
+}
+
+func TestAccountDS(t *testing.T) {
+	dnskey := "@ 300 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ=="
+	zsk := "@ 300 IN DNSKEY 256 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ=="
+	n := indexedNEAR(t, map[string]string{
+		"bob:NS":       "@ 300 IN NS ns1.example.org.",
+		"bob:DNSKEY":   dnskey + "\n" + zsk,
+		"carol:NS":     "@ 300 IN NS ns1.example.org.",
+		"carol:DS":     "@ 300 IN DS 12345 13 2 2bb183af5f22588179a53b0a98631fad1a292118a0f7c5fbd7ab3e2b2a3e5f8e",
+		"carol:DNSKEY": dnskey,
+		"dave:DNSKEY":  dnskey,
+	})
+
+	// DS records are derived from the key signing keys of an account that
+	// publishes no DS records
+	_, dsRrs, _ := n.Delegation("bob.near.", "bob.near.", true)
+	expected := newRR("bob.near. " + strings.TrimPrefix(dnskey, "@ ")).(*dns.DNSKEY).ToDS(dns.SHA256)
+	if len(dsRrs) != 1 || dsRrs[0].(*dns.DS).Digest != expected.Digest {
+		t.Errorf("DS of bob.near. => %v (expected %v)", dsRrs, expected)
+	}
+	_, dsRrs, _ = n.Delegation("carol.near.", "carol.near.", true)
+	if len(dsRrs) != 1 || dsRrs[0].(*dns.DS).KeyTag != 12345 {
+		t.Errorf("DS of carol.near. => %v (expected the published DS)", dsRrs)
+	}
+
+	// DNSKEY records of accounts are never served by the parent
+	for _, name := range []string{"bob.near.", "dave.near."} {
+		a := serve(t, n, name, dns.TypeDNSKEY, false)
+		for _, rr := range append(a.Answer, a.Ns...) {
+			if rr.Header().Rrtype == dns.TypeDNSKEY {
+				t.Errorf("DNSKEY of %s => %v", name, rr)
+			}
+		}
+	}
+}
+
+func TestDelegationFailure(t *testing.T) {
+	n := NEAR{
+		Client:              &nearclient.Client{URL: "http://127.0.0.1:1"},
+		NEARDNS:             "dns.near",
+		NEARLinkNameServers: []string{"ns1.near.link."},
+		Delegations:         NewDelegationCache(time.Hour),
+	}
+
+	// Failures to read the NS or DS records of an account are returned
+	if _, _, err := n.Delegation("alice.near.", "www.alice.near.", false); err == nil {
+		t.Errorf("Delegation with a failing contract succeeded")
+	}
+	n.Delegations.add("bob.near.", []byte("@ 300 IN NS ns1.example.org."))
+	if _, _, err := n.Delegation("bob.near.", "bob.near.", true); err == nil {
+		t.Errorf("Delegation with a failing contract for DS records succeeded")
+	}
+}
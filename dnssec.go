@@ -0,0 +1,307 @@
+package near
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+const (
+	// signatureInception is how far in the past signatures become valid,
+	// to allow for clock skew.
+	signatureInception = 3 * time.Hour
+	// signatureValidity is how long signatures are valid for.
+	signatureValidity = 8 * 24 * time.Hour
+	// signatureRefresh is how long before expiry cached signatures are
+	// replaced.
+	signatureRefresh = 2 * 24 * time.Hour
+	// signatureCacheSize is the number of signed record sets cached.
+	signatureCacheSize = 10000
+)
+
+// SigningKey is a DNSSEC key used to sign answers.
+type SigningKey struct {
+	DNSKEY *dns.DNSKEY
+	Tag    uint16
+
+	signer crypto.Signer
+}
+
+// LoadSigningKey loads a key pair as generated by dnssec-keygen or
+// ldns-keygen from base.key and base.private.
+func LoadSigningKey(base string) (*SigningKey, error) {
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".key"), ".private")
+	pubFile, err := os.Open(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer pubFile.Close()
+	rr, err := dns.ReadRR(pubFile, base+".key")
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key does not hold a DNSKEY", base)
+	}
+
+	privFile, err := os.Open(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer privFile.Close()
+	privKey, err := dnskey.ReadPrivateKey(privFile, base+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s.private does not hold a signing key", base)
+	}
+	return &SigningKey{DNSKEY: dnskey, Tag: dnskey.KeyTag(), signer: signer}, nil
+}
+
+// isKSK returns true if the key is a key signing key.
+func (k *SigningKey) isKSK() bool {
+	return k.DNSKEY.Flags&dns.SEP != 0
+}
+
+// DNSSEC signs answers online with a set of active keys.  If there are both
+// key signing and zone signing keys the former sign the DNSKEY record set
+// and the latter everything else; otherwise every key signs everything.
+// Further keys can be published in the DNSKEY record set without signing,
+// ahead of or after their use.  Signatures are cached by record set.
+type DNSSEC struct {
+	mu         sync.RWMutex
+	active     []*SigningKey
+	published  []*SigningKey
+	generation uint64
+
+	cache *cache.Cache
+}
+
+// NewDNSSEC creates a signer for the keys.
+func NewDNSSEC(keys []*SigningKey) (*DNSSEC, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no DNSSEC keys")
+	}
+	return newDNSSEC(keys, nil), nil
+}
+
+// newDNSSEC creates a signer with active keys and keys that are only
+// published, which may be none until a key manager generates them.
+func newDNSSEC(active []*SigningKey, published []*SigningKey) *DNSSEC {
+	return &DNSSEC{active: active, published: published, cache: cache.New(signatureCacheSize)}
+}
+
+// SetKeys replaces the active keys and the keys that are only published.
+// Signatures by the previous keys are no longer used.
+func (d *DNSSEC) SetKeys(active []*SigningKey, published []*SigningKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active = active
+	d.published = published
+	d.generation++
+}
+
+// Keys returns the active keys.
+func (d *DNSSEC) Keys() []*SigningKey {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.active
+}
+
+// DNSKEYs returns the DNSKEY records of the active and published keys at
+// the apex.
+func (d *DNSSEC) DNSKEYs(apex string, ttl uint32) []dns.RR {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	results := make([]dns.RR, 0, len(d.active)+len(d.published))
+	for _, keys := range [][]*SigningKey{d.active, d.published} {
+		for _, key := range keys {
+			dnskey := *key.DNSKEY
+			dnskey.Hdr = dns.RR_Header{Name: apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: ttl}
+			results = append(results, &dnskey)
+		}
+	}
+	return results
+}
+
+// splitKeys returns true if signing is split between key signing and zone
+// signing keys.
+func splitKeys(keys []*SigningKey) bool {
+	ksks := 0
+	for _, key := range keys {
+		if key.isKSK() {
+			ksks++
+		}
+	}
+	return ksks > 0 && ksks < len(keys)
+}
+
+// Sign returns the records with signatures by signer added after each record
+// set below signer.  Existing signatures are dropped, and the records of a
+// set are given the lowest TTL in the set (RFC 2181 section 5.2).
+func (d *DNSSEC) Sign(rrs []dns.RR, signer string, now time.Time) ([]dns.RR, error) {
+	results := make([]dns.RR, 0, len(rrs)*2)
+	for _, rrSet := range splitRRSets(rrs) {
+		results = append(results, rrSet...)
+		if !dns.IsSubDomain(signer, rrSet[0].Header().Name) {
+			continue
+		}
+		ttl := rrSet[0].Header().Ttl
+		for _, rr := range rrSet {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		for _, rr := range rrSet {
+			rr.Header().Ttl = ttl
+		}
+		sigs, err := d.sign(rrSet, signer, now)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, sigs...)
+	}
+	return results, nil
+}
+
+// sign returns the signatures of a record set, from the cache if they are
+// not close to expiry.
+func (d *DNSSEC) sign(rrSet []dns.RR, signer string, now time.Time) ([]dns.RR, error) {
+	d.mu.RLock()
+	keys, generation := d.active, d.generation
+	d.mu.RUnlock()
+
+	key := rrSetHash(rrSet, signer, generation)
+	if cached, ok := d.cache.Get(key); ok {
+		sigs := cached.([]dns.RR)
+		if len(sigs) > 0 && int64(sigs[0].(*dns.RRSIG).Expiration) > now.Add(signatureRefresh).Unix() {
+			return sigs, nil
+		}
+	}
+
+	isDNSKEY := rrSet[0].Header().Rrtype == dns.TypeDNSKEY
+	split := splitKeys(keys)
+	sigs := make([]dns.RR, 0, len(keys))
+	for _, key := range keys {
+		if split && key.isKSK() != isDNSKEY {
+			continue
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrSet[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrSet[0].Header().Ttl},
+			Algorithm:  key.DNSKEY.Algorithm,
+			KeyTag:     key.Tag,
+			SignerName: signer,
+			Inception:  uint32(now.Add(-signatureInception).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := sig.Sign(key.signer, rrSet); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	d.cache.Add(key, sigs)
+	return sigs, nil
+}
+
+// splitRRSets groups records into record sets by owner and type, in order of
+// first appearance.  Signatures and OPT records are dropped.
+func splitRRSets(rrs []dns.RR) [][]dns.RR {
+	type rrSetKey struct {
+		name  string
+		qtype uint16
+	}
+	index := make(map[rrSetKey]int)
+	rrSets := make([][]dns.RR, 0)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrSetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+		i, exists := index[key]
+		if !exists {
+			i = len(rrSets)
+			index[key] = i
+			rrSets = append(rrSets, nil)
+		}
+		rrSets[i] = append(rrSets[i], rr)
+	}
+	return rrSets
+}
+
+// rrSetHash returns the cache key of the signatures of a record set by a
+// generation of keys.
+func rrSetHash(rrSet []dns.RR, signer string, generation uint64) uint64 {
+	texts := make([]string, len(rrSet))
+	for i, rr := range rrSet {
+		texts[i] = rr.String()
+	}
+	sort.Strings(texts)
+	return cache.Hash([]byte(fmt.Sprintf("%d\n%s\n%s", generation, signer, strings.Join(texts, "\n"))))
+}
+
+// signResponse signs the answer and authority sections of a response with
+// the keys of the served zone.  Negative answers are proven with NSEC black
+// lies, which turn NXDOMAIN into NODATA, so the result is returned as
+// updated.  Referrals are only signed over their DS records, or the NSEC
+// record that denies them, as the NS records at a zone cut belong to the
+// child.
+func (n NEAR) signResponse(a *dns.Msg, result Result, qtype uint16, now time.Time) (Result, error) {
+	var err error
+	zone := n.zone()
+	switch result {
+	case NoData, NameError:
+		owner := negativeOwner(strings.ToLower(a.Question[0].Name), a.Answer)
+		if dns.IsSubDomain(zone, owner) {
+			a.Ns = append(a.Ns, n.blackLie(owner, n.internalName(owner), qtype, result, n.negativeTTL(a.Ns)))
+			result = NoData
+		}
+	case Delegation:
+		hasDS := false
+		for _, rr := range a.Ns {
+			hasDS = hasDS || rr.Header().Rrtype == dns.TypeDS
+		}
+		if !hasDS && len(a.Ns) > 0 {
+			// Prove that the delegation is insecure
+			cut := a.Ns[0].Header().Name
+			a.Ns = append(a.Ns, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: cut, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: n.soaConfig().Minimum},
+				NextDomain: "\\000." + cut,
+				TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+			})
+		}
+	}
+
+	if a.Answer, err = n.DNSSEC.Sign(a.Answer, zone, now); err != nil {
+		return result, err
+	}
+	if result != Delegation {
+		a.Ns, err = n.DNSSEC.Sign(a.Ns, zone, now)
+		return result, err
+	}
+	nsRrs := make([]dns.RR, 0, len(a.Ns))
+	otherRrs := make([]dns.RR, 0)
+	for _, rr := range a.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			nsRrs = append(nsRrs, rr)
+		} else {
+			otherRrs = append(otherRrs, rr)
+		}
+	}
+	if otherRrs, err = n.DNSSEC.Sign(otherRrs, zone, now); err != nil {
+		return result, err
+	}
+	a.Ns = append(nsRrs, otherRrs...)
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package near
+
+import (
+	"context"
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// newTestKey generates a signing key for the zone.
+func newTestKey(t *testing.T, zone string, flags uint16) (*SigningKey, crypto.PrivateKey) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := dnskey.Generate(256)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return &SigningKey{DNSKEY: dnskey, Tag: dnskey.KeyTag(), signer: priv.(crypto.Signer)}, priv
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	key, priv := newTestKey(t, "near.", 257)
+	base := filepath.Join(t.TempDir(), "Knear.+013+00001")
+	if err := os.WriteFile(base+".key", []byte(key.DNSKEY.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".private", []byte(key.DNSKEY.PrivateKeyString(priv)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadSigningKey(base + ".key")
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+	if loaded.Tag != key.Tag || !loaded.isKSK() {
+		t.Errorf("loaded key %v (expected %v)", loaded.DNSKEY, key.DNSKEY)
+	}
+	if _, err := LoadSigningKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("expected error loading missing key")
+	}
+}
+
+func TestSign(t *testing.T) {
+	ksk, _ := newTestKey(t, "near.", 257)
+	zsk, _ := newTestKey(t, "near.", 256)
+	d, err := NewDNSSEC([]*SigningKey{ksk, zsk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	rrs := []dns.RR{
+		newRR("alice.near. 300 IN A 192.0.2.1"),
+		newRR("alice.near. 600 IN A 192.0.2.2"),
+		newRR("ns1.example.org. 300 IN A 192.0.2.53"),
+	}
+	signed, err := d.Sign(rrs, "near.", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != 4 {
+		t.Fatalf("expected 4 records, got %v", signed)
+	}
+	sig, ok := signed[2].(*dns.RRSIG)
+	if !ok || sig.KeyTag != zsk.Tag {
+		t.Fatalf("expected signature by ZSK, got %v", signed[2])
+	}
+	if signed[1].Header().Ttl != 300 {
+		t.Errorf("expected TTL of record set to be lowered to 300, got %d", signed[1].Header().Ttl)
+	}
+	if err := sig.Verify(zsk.DNSKEY, signed[:2]); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+
+	// Signatures are cached
+	again, err := d.Sign(signed, "near.", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 4 || again[2].String() != sig.String() {
+		t.Errorf("expected cached signature, got %v", again)
+	}
+
+	// DNSKEY records are signed by the KSK
+	keys, err := d.Sign(d.DNSKEYs("near.", 3600), "near.", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[2].(*dns.RRSIG).KeyTag != ksk.Tag {
+		t.Errorf("expected DNSKEY signed by KSK, got %v", keys)
+	}
+}
+
+func TestServeDNSKEY(t *testing.T) {
+	key, _ := newTestKey(t, "near.link.", 257)
+	d, err := NewDNSSEC([]*SigningKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NEAR{Next: test.ErrorHandler(), NEARLinkNameServers: []string{"ns1.neardns.xyz."}, DNSSEC: d, Zone: "near.link."}
+
+	r := new(dns.Msg)
+	r.SetQuestion("near.link.", dns.TypeDNSKEY)
+	r.SetEdns0(4096, true)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := n.ServeDNS(context.TODO(), rec, r); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || len(rec.Msg.Answer) != 2 {
+		t.Fatalf("expected DNSKEY and RRSIG, got %v", rec.Msg)
+	}
+	dnskey := rec.Msg.Answer[0]
+	sig, ok := rec.Msg.Answer[1].(*dns.RRSIG)
+	if dnskey.Header().Name != "near.link." || !ok || sig.SignerName != "near.link." {
+		t.Fatalf("unexpected answer %v", rec.Msg.Answer)
+	}
+	if err := sig.Verify(key.DNSKEY, []dns.RR{dnskey}); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestSignZoneNames(t *testing.T) {
+	key, _ := newTestKey(t, "near.link.", 257)
+	d, err := NewDNSSEC([]*SigningKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := indexedNEAR(t, map[string]string{
+		"carol:MX":            "@ 300 IN MX 10 mail.carol.near.",
+		"carol:SRV:_sip._tcp": "_sip._tcp 300 IN SRV 10 5 5060 sip.carol.near.",
+		"alice:DNAME":         "@ 300 IN DNAME bob.near.",
+	})
+	n.Zone = "near.link."
+	n.DNSSEC = d
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		record string
+	}{
+		{"carol.near.link.", dns.TypeMX, "carol.near.link. MX 10 mail.carol.near.link."},
+		{"_sip._tcp.carol.near.link.", dns.TypeSRV, "_sip._tcp.carol.near.link. SRV 10 5 5060 sip.carol.near.link."},
+		{"www.alice.near.link.", dns.TypeA, "alice.near.link. DNAME bob.near.link."},
+		{"www.alice.near.link.", dns.TypeA, "www.alice.near.link. CNAME www.bob.near.link."},
+		{"near.link.", dns.TypeSOA, "near.link. SOA ns1.near.link. hostmaster.near.link. 1 3600 600 1209600 300"},
+	}
+	for _, tt := range tests {
+		a := serve(t, n, tt.qname, tt.qtype, true)
+		if !hasRecord(a.Answer, tt.record) {
+			t.Errorf("answer for %s => %v (expected %s)", tt.qname, a.Answer, tt.record)
+		}
+		verifyRRSets(t, key.DNSKEY, a.Answer)
+	}
+
+	// Negative answers carry the apex SOA and an NSEC record in the zone
+	a := serve(t, n, "carol.near.link.", dns.TypeTXT, true)
+	if !hasRecord(a.Ns, "near.link. SOA ns1.near.link. hostmaster.near.link. 1 3600 600 1209600 300") {
+		t.Errorf("authority for carol.near.link. TXT => %v (expected the apex SOA)", a.Ns)
+	}
+	for _, rr := range a.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok && !dns.IsSubDomain("near.link.", nsec.NextDomain) {
+			t.Errorf("NSEC for carol.near.link. => %v (expected a next name in the zone)", nsec)
+		}
+	}
+	verifyRRSets(t, key.DNSKEY, a.Ns)
+}
+
+// verifyRRSets checks that every record set in the records is signed by the
+// key.
+func verifyRRSets(t *testing.T, key *dns.DNSKEY, rrs []dns.RR) {
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		rrSet := make([]dns.RR, 0)
+		for _, signed := range rrs {
+			if signed.Header().Rrtype == sig.TypeCovered && signed.Header().Name == sig.Hdr.Name {
+				rrSet = append(rrSet, signed)
+			}
+		}
+		if err := sig.Verify(key, rrSet); err != nil {
+			t.Errorf("signature over %v does not verify: %v", rrSet, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package near
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/miekg/dns"
+)
+
+// defaultGatewayRefresh is the default interval between resolutions of
+// IPFS gateway hostnames.
+const defaultGatewayRefresh = 5 * time.Minute
+
+// GatewayResolver periodically resolves IPFS gateway hostnames through an
+// upstream resolver and caches the resulting addresses.
+type GatewayResolver struct {
+	Names    []string
+	Upstream string
+	Refresh  time.Duration
+
+	client *dns.Client
+	mu     sync.RWMutex
+	as     []string
+	aaaas  []string
+	stop   chan struct{}
+}
+
+// NewGatewayResolver creates a resolver for the supplied gateway hostnames.
+// If upstream is empty the first nameserver in /etc/resolv.conf is used.
+func NewGatewayResolver(names []string, upstream string, refresh time.Duration) (*GatewayResolver, error) {
+	if upstream == "" {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		if len(config.Servers) == 0 {
+			return nil, fmt.Errorf("no nameservers in /etc/resolv.conf")
+		}
+		upstream = net.JoinHostPort(config.Servers[0], config.Port)
+	} else if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	if refresh <= 0 {
+		refresh = defaultGatewayRefresh
+	}
+	fqdns := make([]string, len(names))
+	for i := range names {
+		fqdns[i] = dns.Fqdn(strings.ToLower(names[i]))
+	}
+
+	return &GatewayResolver{
+		Names:    fqdns,
+		Upstream: upstream,
+		Refresh:  refresh,
+		client:   &dns.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// Start resolves the gateway hostnames and keeps them refreshed until Stop is
+// called.
+func (g *GatewayResolver) Start() error {
+	g.resolve()
+	g.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(g.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C:
+				g.resolve()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops refreshing the gateway hostnames.
+func (g *GatewayResolver) Stop() error {
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+	return nil
+}
+
+// Addresses returns the most recently resolved IPv4 and IPv6 gateway
+// addresses.
+func (g *GatewayResolver) Addresses() ([]string, []string) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.as, g.aaaas
+}
+
+// resolve looks up the gateway hostnames.  If a lookup fails the previous
+// addresses for that family are kept, so a transient upstream failure does
+// not empty the gateway pool.
+func (g *GatewayResolver) resolve() {
+	as, aErr := g.lookup(dns.TypeA)
+	aaaas, aaaaErr := g.lookup(dns.TypeAAAA)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if aErr == nil {
+		g.as = as
+	}
+	if aaaaErr == nil {
+		g.aaaas = aaaas
+	}
+}
+
+func (g *GatewayResolver) lookup(qtype uint16) ([]string, error) {
+	results := make([]string, 0)
+	for _, name := range g.Names {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.RecursionDesired = true
+		resp, _, err := g.client.Exchange(m, g.Upstream)
+		if err != nil {
+			log.Warnf("failed to resolve IPFS gateway %s: %v", name, err)
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+			log.Warnf("failed to resolve IPFS gateway %s: %v", name, err)
+			return nil, err
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				results = append(results, rr.A.String())
+			case *dns.AAAA:
+				results = append(results, rr.AAAA.String())
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,54 @@
+package near
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestGatewayResolver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, newRR("gateway.example.org. 300 IN A 192.0.2.1"))
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, newRR("gateway.example.org. 300 IN AAAA 2001:db8::1"))
+		}
+		w.WriteMsg(m)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	g, err := NewGatewayResolver([]string{"Gateway.example.org"}, pc.LocalAddr().String(), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create resolver: %v", err)
+	}
+	if err := g.Start(); err != nil {
+		t.Fatalf("Failed to start resolver: %v", err)
+	}
+	defer g.Stop()
+
+	as, aaaas := g.Addresses()
+	if len(as) != 1 || as[0] != "192.0.2.1" {
+		t.Errorf("Unexpected A addresses %v", as)
+	}
+	if len(aaaas) != 1 || aaaas[0] != "2001:db8::1" {
+		t.Errorf("Unexpected AAAA addresses %v", aaaas)
+	}
+	if g.Names[0] != "gateway.example.org." {
+		t.Errorf("Unexpected gateway name %v", g.Names[0])
+	}
+
+	n := NEAR{IPFSGatewayAs: []string{"198.51.100.1"}, GatewayResolver: g}
+	if pool := n.gatewayPool(); len(pool.As) != 2 || len(pool.AAAAs) != 1 {
+		t.Errorf("Unexpected gateway pool %v", pool)
+	}
+}
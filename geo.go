@@ -0,0 +1,182 @@
+package near
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// GatewayPool is a set of IPFS gateway addresses that serve a region.
+type GatewayPool struct {
+	As    []string
+	AAAAs []string
+}
+
+// geoEntry maps a network to a region.
+type geoEntry struct {
+	network *net.IPNet
+	region  string
+}
+
+// GeoMap maps client networks to regions.  Lookups return the region of the
+// most specific network that contains the address.
+type GeoMap struct {
+	entries []geoEntry
+}
+
+// NewGeoMap creates an empty CIDR-to-region map.
+func NewGeoMap() *GeoMap {
+	return &GeoMap{entries: make([]geoEntry, 0)}
+}
+
+// Add adds a CIDR-to-region mapping.
+func (g *GeoMap) Add(cidr string, region string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	g.entries = append(g.entries, geoEntry{network: network, region: region})
+	return nil
+}
+
+// Region returns the region of the longest matching network for the
+// supplied address, and the prefix length of that network.  It returns an
+// empty region if there is no match.
+func (g *GeoMap) Region(ip net.IP) (string, int) {
+	region := ""
+	best := -1
+	if g == nil || ip == nil {
+		return region, 0
+	}
+	for _, entry := range g.entries {
+		if !entry.network.Contains(ip) {
+			continue
+		}
+		ones, _ := entry.network.Mask.Size()
+		if ones > best {
+			best = ones
+			region = entry.region
+		}
+	}
+	if best < 0 {
+		return "", 0
+	}
+	return region, best
+}
+
+// Len returns the number of networks in the map.
+func (g *GeoMap) Len() int {
+	if g == nil {
+		return 0
+	}
+	return len(g.entries)
+}
+
+// loadGeoMap reads a CIDR-to-region mapping file.  Each non-empty line holds a
+// CIDR followed by a region name; anything after a '#' is a comment.
+func loadGeoMap(path string) (*GeoMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseGeoMap(file)
+}
+
+func parseGeoMap(r io.Reader) (*GeoMap, error) {
+	geoMap := NewGeoMap()
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected CIDR and region", line)
+		}
+		if err := geoMap.Add(fields[0], strings.ToLower(fields[1])); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return geoMap, nil
+}
+
+// clientSubnet returns the address that identifies the client for gateway
+// selection.  The EDNS Client Subnet option is preferred if present,
+// otherwise the source address of the request is used.  An option with a
+// source prefix of 0 is the client opting out (RFC 7871 section 7.1.2), so
+// the source address is used, but the option is still returned to be
+// answered.
+func clientSubnet(state request.Request) (net.IP, *dns.EDNS0_SUBNET) {
+	var subnet *dns.EDNS0_SUBNET
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				if ecs.SourceNetmask > 0 && ecs.Address != nil {
+					return ecs.Address, ecs
+				}
+				subnet = ecs
+			}
+		}
+	}
+	if state.W == nil {
+		return nil, subnet
+	}
+	return net.ParseIP(state.IP()), subnet
+}
+
+// gatewayPool returns the IPFS gateway pool for the current client.  If the
+// client does not map to a configured pool the default gateways are used.
+func (n NEAR) gatewayPool() GatewayPool {
+	defaultPool := GatewayPool{As: n.IPFSGatewayAs, AAAAs: n.IPFSGatewayAAAAs}
+	if n.GatewayResolver != nil {
+		as, aaaas := n.GatewayResolver.Addresses()
+		defaultPool.As = append(append([]string{}, defaultPool.As...), as...)
+		defaultPool.AAAAs = append(append([]string{}, defaultPool.AAAAs...), aaaas...)
+	}
+	if len(n.GatewayPools) == 0 {
+		return defaultPool
+	}
+	if n.gatewaySelected != nil {
+		*n.gatewaySelected = true
+	}
+	region, _ := n.GeoMap.Region(n.clientIP)
+	if pool, exists := n.GatewayPools[region]; exists {
+		return *pool
+	}
+	return defaultPool
+}
+
+// ecsScope sets the scope prefix length of an EDNS Client Subnet option to
+// reflect the precision used when selecting the gateway pool.  Answers that
+// are not tailored to the client, and options that opt out, have a scope of
+// 0 so that they can be cached for all clients.
+func (n NEAR) ecsScope(ecs *dns.EDNS0_SUBNET, tailored bool) *dns.EDNS0_SUBNET {
+	prefix := 0
+	if tailored && ecs.SourceNetmask > 0 {
+		_, prefix = n.GeoMap.Region(ecs.Address)
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   uint8(prefix),
+		Address:       ecs.Address,
+	}
+}
@@ -0,0 +1,114 @@
+package near
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestGeoMapRegion(t *testing.T) {
+	geoMap, err := parseGeoMap(strings.NewReader(`
+# Regions
+10.0.0.0/8       EU
+10.1.0.0/16      us   # more specific
+2001:db8::/32    apac
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse geo map: %v", err)
+	}
+
+	tests := []struct {
+		ip     string
+		region string
+		prefix int
+	}{
+		{"10.2.3.4", "eu", 8},
+		{"10.1.3.4", "us", 16},
+		{"2001:db8::1", "apac", 32},
+		{"192.0.2.1", "", 0},
+	}
+	for _, tt := range tests {
+		region, prefix := geoMap.Region(net.ParseIP(tt.ip))
+		if region != tt.region || prefix != tt.prefix {
+			t.Errorf("Failure: %v => %v/%d (expected %v/%d)\n", tt.ip, region, prefix, tt.region, tt.prefix)
+		}
+	}
+}
+
+func TestGeoMapParseErrors(t *testing.T) {
+	tests := []string{
+		"10.0.0.0/8",
+		"10.0.0.0/33 eu",
+		"10.0.0.0/8 eu extra",
+	}
+	for _, tt := range tests {
+		if _, err := parseGeoMap(strings.NewReader(tt)); err == nil {
+			t.Errorf("Expected error parsing %q", tt)
+		}
+	}
+}
+
+func TestGatewayPool(t *testing.T) {
+	geoMap := NewGeoMap()
+	geoMap.Add("192.0.2.0/24", "eu")
+	n := NEAR{
+		IPFSGatewayAs: []string{"198.51.100.1"},
+		GeoMap:        geoMap,
+		GatewayPools: map[string]*GatewayPool{
+			"eu": {As: []string{"203.0.113.1"}},
+		},
+	}
+
+	n.clientIP = net.ParseIP("192.0.2.10")
+	if as := n.gatewayPool().As; len(as) != 1 || as[0] != "203.0.113.1" {
+		t.Errorf("Expected regional gateway, got %v", as)
+	}
+	n.clientIP = net.ParseIP("198.18.0.1")
+	if as := n.gatewayPool().As; len(as) != 1 || as[0] != "198.51.100.1" {
+		t.Errorf("Expected default gateway, got %v", as)
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		address string
+		netmask uint8
+		client  string
+	}{
+		{"192.0.2.0", 24, "192.0.2.0"},
+		// Source prefix 0 opts out; the source address is used
+		{"0.0.0.0", 0, "10.240.0.1"},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("alice.near.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: tt.netmask, Address: net.ParseIP(tt.address)})
+		ip, ecs := clientSubnet(request.Request{W: &test.ResponseWriter{}, Req: r})
+		if ip.String() != tt.client || ecs == nil {
+			t.Errorf("Failure: %s/%d => %v, %v (expected %s)\n", tt.address, tt.netmask, ip, ecs, tt.client)
+		}
+	}
+}
+
+func TestECSScope(t *testing.T) {
+	geoMap := NewGeoMap()
+	geoMap.Add("192.0.2.0/24", "eu")
+	n := NEAR{GeoMap: geoMap}
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")}
+	if scope := n.ecsScope(ecs, true).SourceScope; scope != 24 {
+		t.Errorf("Expected scope 24 for a tailored answer, got %d", scope)
+	}
+	if scope := n.ecsScope(ecs, false).SourceScope; scope != 0 {
+		t.Errorf("Expected scope 0 for an answer that is not tailored, got %d", scope)
+	}
+	ecs.SourceNetmask = 0
+	if scope := n.ecsScope(ecs, true).SourceScope; scope != 0 {
+		t.Errorf("Expected scope 0 for an opted out client, got %d", scope)
+	}
+}
@@ -0,0 +1,29 @@
+package near
+
+import (
+	"github.com/miekg/dns"
+)
+
+// handleGlue answers address queries for one of the plugin's own
+// nameservers from its configured addresses.
+func (n NEAR) handleGlue(name string, qtype uint16) []dns.RR {
+	results := make([]dns.RR, 0)
+	for _, ip := range parseIPs(n.NameServerAddresses[n.externalName(name)]) {
+		hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: n.synthesizedTTL(qtype, false)}
+		switch {
+		case qtype == dns.TypeA && ip.To4() != nil:
+			results = append(results, &dns.A{Hdr: hdr, A: ip})
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			results = append(results, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return results
+}
+
+// isNameServer returns true if the name is one of the plugin's own
+// nameservers with configured addresses.  The addresses are configured by
+// the name in the served zone, so names below zoneApex are mapped to it.
+func (n NEAR) isNameServer(name string) bool {
+	_, exists := n.NameServerAddresses[n.externalName(name)]
+	return exists
+}
@@ -0,0 +1,76 @@
+package near
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestLookupGlue(t *testing.T) {
+	n := NEAR{
+		NEARLinkNameServers: []string{"ns1.neardns.xyz.", "ns2.neardns.xyz.", "ns3.example.org."},
+		NameServerAddresses: map[string][]string{
+			"ns1.neardns.xyz.": {"192.0.2.1", "2001:db8::1"},
+			"ns2.neardns.xyz.": {"192.0.2.2"},
+		},
+	}
+
+	tests := []struct {
+		qname      string
+		qtype      uint16
+		result     Result
+		answer     []string
+		additional []string
+	}{
+		{"near.", dns.TypeNS, Success,
+			[]string{"near. 3600 IN NS ns1.neardns.xyz.", "near. 3600 IN NS ns2.neardns.xyz.", "near. 3600 IN NS ns3.example.org."},
+			[]string{"ns1.neardns.xyz. 3600 IN A 192.0.2.1", "ns1.neardns.xyz. 3600 IN AAAA 2001:db8::1", "ns2.neardns.xyz. 3600 IN A 192.0.2.2"}},
+		{"ns1.neardns.xyz.", dns.TypeA, Success, []string{"ns1.neardns.xyz. 3600 IN A 192.0.2.1"}, nil},
+		{"ns2.neardns.xyz.", dns.TypeAAAA, NoData, nil, nil},
+	}
+	for i, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		state := request.Request{W: &test.ResponseWriter{}, Req: r}
+		answer, _, additional, result := Lookup(n, state)
+		if result != tt.result {
+			t.Errorf("Test %d: result %d (expected %d)", i, result, tt.result)
+		}
+		if len(answer) != len(tt.answer) || len(additional) != len(tt.additional) {
+			t.Errorf("Test %d: got %v %v (expected %v %v)", i, answer, additional, tt.answer, tt.additional)
+			continue
+		}
+		for j := range answer {
+			if answer[j].String() != newRR(tt.answer[j]).String() {
+				t.Errorf("Test %d: answer %v (expected %v)", i, answer[j], tt.answer[j])
+			}
+		}
+		for j := range additional {
+			if additional[j].String() != newRR(tt.additional[j]).String() {
+				t.Errorf("Test %d: additional %v (expected %v)", i, additional[j], tt.additional[j])
+			}
+		}
+	}
+}
+
+func TestZoneGlue(t *testing.T) {
+	n := indexedNEAR(t, nil)
+	n.Zone = "near.link."
+	n.NEARLinkNameServers = []string{"ns1.near.link.", "ns2.example.org."}
+	n.NameServerAddresses = map[string][]string{"ns1.near.link.": {"192.0.2.1", "2001:db8::1"}}
+
+	a := serve(t, n, "ns1.near.link.", dns.TypeA, false)
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 1 || !hasRecord(a.Answer, "ns1.near.link. A 192.0.2.1") {
+		t.Errorf("A of ns1.near.link. => %s, %v", dns.RcodeToString[a.Rcode], a.Answer)
+	}
+	a = serve(t, n, "ns1.near.link.", dns.TypeAAAA, false)
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 1 || !hasRecord(a.Answer, "ns1.near.link. AAAA 2001:db8::1") {
+		t.Errorf("AAAA of ns1.near.link. => %s, %v", dns.RcodeToString[a.Rcode], a.Answer)
+	}
+	a = serve(t, n, "near.link.", dns.TypeNS, false)
+	if len(a.Answer) != 2 || len(a.Extra) != 2 || !hasRecord(a.Extra, "ns1.near.link. A 192.0.2.1") {
+		t.Errorf("NS of near.link. => %v, additional %v", a.Answer, a.Extra)
+	}
+}
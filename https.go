@@ -0,0 +1,102 @@
+package near
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// HTTPSConfig holds the service parameters of synthesized HTTPS and SVCB
+// records for gateway-served names.
+type HTTPSConfig struct {
+	Alpn []string
+	Port uint16
+}
+
+// defaultHTTPSAlpn is the ALPN list advertised when none is configured.
+var defaultHTTPSAlpn = []string{"h2", "http/1.1"}
+
+func (n NEAR) handleHTTPS(name string, domain string, contentHash []byte, qtype uint16) ([]dns.RR, error) {
+	results := make([]dns.RR, 0)
+
+	// Service bindings in the contract override the synthesized ones
+	rrSet, err := n.obtainHTTPSRRSet(name, domain)
+	if err == nil && len(rrSet) != 0 {
+		results = n.contractRRSet(domain, rrSet, name, qtype)
+		if len(results) > 0 {
+			return results, nil
+		}
+	}
+
+	if n.HTTPS == nil {
+		return results, nil
+	}
+	// The hints are the addresses the name is answered with
+	aRrs, err := n.handleA(name, domain, contentHash)
+	if err != nil {
+		return results, err
+	}
+	aaaaRrs, err := n.handleAAAA(name, domain, contentHash)
+	if err != nil {
+		return results, err
+	}
+	results = append(results, n.synthesizeHTTPS(name, qtype, addressHints(aRrs), addressHints(aaaaRrs)))
+
+	return results, nil
+}
+
+// synthesizeHTTPS creates an HTTPS or SVCB record for a gateway-served name
+// with the address hints of the name.
+func (n NEAR) synthesizeHTTPS(name string, qtype uint16, ipv4Hints []net.IP, ipv6Hints []net.IP) dns.RR {
+	svcb := dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: qtype,
+			Class:  dns.ClassINET,
+			Ttl:    n.synthesizedTTL(qtype, true),
+		},
+		Priority: 1,
+		Target:   ".",
+	}
+	if len(n.HTTPS.Alpn) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: n.HTTPS.Alpn})
+	}
+	if n.HTTPS.Port != 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: n.HTTPS.Port})
+	}
+	if len(ipv4Hints) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: ipv4Hints})
+	}
+	if len(ipv6Hints) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: ipv6Hints})
+	}
+
+	if qtype == dns.TypeHTTPS {
+		return &dns.HTTPS{SVCB: svcb}
+	}
+	return &svcb
+}
+
+// addressHints returns the addresses of A and AAAA records.
+func addressHints(rrs []dns.RR) []net.IP {
+	ips := make([]net.IP, 0, len(rrs))
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips
+}
+
+func parseIPs(addresses []string) []net.IP {
+	ips := make([]net.IP, 0, len(addresses))
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,49 @@
+package near
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSynthesizeHTTPS(t *testing.T) {
+	n := NEAR{
+		IPFSGatewayAs:    []string{"192.0.2.1", "192.0.2.2"},
+		IPFSGatewayAAAAs: []string{"2001:db8::1"},
+		HTTPS:            &HTTPSConfig{Alpn: defaultHTTPSAlpn, Port: 8443},
+	}
+
+	tests := []struct {
+		qtype  uint16
+		record string
+	}{
+		{dns.TypeHTTPS, `alice.near. 3600 IN HTTPS 1 . alpn="h2,http/1.1" port="8443" ipv4hint="192.0.2.1,192.0.2.2" ipv6hint="2001:db8::1"`},
+		{dns.TypeSVCB, `alice.near. 3600 IN SVCB 1 . alpn="h2,http/1.1" port="8443" ipv4hint="192.0.2.1,192.0.2.2" ipv6hint="2001:db8::1"`},
+	}
+	for i, tt := range tests {
+		rr := n.synthesizeHTTPS("alice.near.", tt.qtype, parseIPs(n.IPFSGatewayAs), parseIPs(n.IPFSGatewayAAAAs))
+		if rr.Header().Rrtype != tt.qtype {
+			t.Errorf("Test %d: unexpected type %d", i, rr.Header().Rrtype)
+		}
+		if !dns.IsDuplicate(rr, newRR(tt.record)) {
+			t.Errorf("Test %d: got %v (expected %v)", i, rr, tt.record)
+		}
+	}
+}
+
+func TestHTTPSHints(t *testing.T) {
+	n := indexedNEAR(t, map[string]string{
+		"alice:contenthash": testContentHash,
+		"alice:A":           "@ 300 IN A 192.0.2.9",
+	})
+	n.IPFSGatewayAs = []string{"192.0.2.1"}
+	n.IPFSGatewayAAAAs = []string{"2001:db8::1"}
+	n.HTTPS = &HTTPSConfig{Alpn: defaultHTTPSAlpn}
+
+	// Addresses in the contract are hinted instead of the gateway's
+	rrs, err := n.Query("alice.near.", "alice.near.", dns.TypeHTTPS, false)
+	expected := `alice.near. 3600 IN HTTPS 1 . alpn="h2,http/1.1" ipv4hint="192.0.2.9" ipv6hint="2001:db8::1"`
+	if err != nil || len(rrs) != 1 || !dns.IsDuplicate(rrs[0], newRR(expected)) {
+		t.Errorf("HTTPS of alice.near. => %v, %v (expected %s)", rrs, err, expected)
+	}
+}
@@ -0,0 +1,479 @@
+package near
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultZSKLifetime is the default time a zone signing key is used.
+	defaultZSKLifetime = 30 * 24 * time.Hour
+	// defaultKSKLifetime is the default time a key signing key is used.
+	defaultKSKLifetime = 365 * 24 * time.Hour
+	// defaultKeyPrepublish is the default time keys are published before
+	// they are used, and kept published after they are retired.
+	defaultKeyPrepublish = 2 * 24 * time.Hour
+	// keyCheckInterval is the interval between checks of the key schedule.
+	keyCheckInterval = time.Hour
+	// keyStateFile is the file in the key directory that holds the key
+	// schedule.
+	keyStateFile = "keys.json"
+	// dsQueryTimeout is the timeout of DS queries to the parent resolver.
+	dsQueryTimeout = 5 * time.Second
+)
+
+// managedKey is the schedule of a key.  A key is in the DNSKEY record set
+// from Publish until Remove, and signs from Activate until Retire.  DSSeen
+// is when the DS record of a key signing key was confirmed at the parent.
+type managedKey struct {
+	Base     string    `json:"base"`
+	KSK      bool      `json:"ksk"`
+	Publish  time.Time `json:"publish"`
+	Activate time.Time `json:"activate"`
+	Retire   time.Time `json:"retire"`
+	Remove   time.Time `json:"remove"`
+	DSSeen   time.Time `json:"ds_seen,omitempty"`
+
+	key *SigningKey
+}
+
+// KeyManager generates and rolls the DNSSEC keys of the served zone, keeping
+// the keys and their schedule in a directory.  Zone signing keys are rolled
+// with the pre-publish method: the successor is published Prepublish before
+// it takes over, and the retired key stays published for Prepublish after.
+// Key signing keys are rolled with the double-signature method: the
+// successor signs alongside the current key from Prepublish before the
+// current key is due to retire, during which the DS record at the parent
+// must be replaced.  The DS records of the published key signing keys are
+// written to dsset-<zone> in the directory.
+//
+// A key signing key keeps signing past its retirement until the DS record of
+// its successor is confirmed at the parent, and for Prepublish after that so
+// that resolvers drop the old DS record.  The DS record is confirmed by
+// querying the Parent resolver, if set, or by the operator creating the file
+// dspublished-<zone> in the directory.
+type KeyManager struct {
+	Dir         string
+	Zone        string
+	Algorithm   uint8
+	ZSKLifetime time.Duration
+	KSKLifetime time.Duration
+	Prepublish  time.Duration
+	DNSSEC      *DNSSEC
+	// Parent, if set, is the address of a resolver that is asked for the DS
+	// records of the zone.
+	Parent string
+
+	mu   sync.Mutex
+	keys []*managedKey
+	ds   string
+	stop chan struct{}
+}
+
+// NewKeyManager creates a key manager for the zone, loading any keys in the
+// directory.  Zero durations take their defaults.  Nothing is written until
+// the keys are first rolled.
+func NewKeyManager(dir string, zone string, algorithm uint8, zskLifetime time.Duration, kskLifetime time.Duration, prepublish time.Duration) (*KeyManager, error) {
+	if _, exists := dns.AlgorithmToString[algorithm]; !exists {
+		return nil, fmt.Errorf("unknown algorithm %d", algorithm)
+	}
+	if zskLifetime <= 0 {
+		zskLifetime = defaultZSKLifetime
+	}
+	if kskLifetime <= 0 {
+		kskLifetime = defaultKSKLifetime
+	}
+	if prepublish <= 0 {
+		prepublish = defaultKeyPrepublish
+	}
+	if prepublish >= zskLifetime || prepublish >= kskLifetime {
+		return nil, errors.New("key prepublication must be shorter than key lifetimes")
+	}
+	m := &KeyManager{
+		Dir:         dir,
+		Zone:        dns.Fqdn(strings.ToLower(zone)),
+		Algorithm:   algorithm,
+		ZSKLifetime: zskLifetime,
+		KSKLifetime: kskLifetime,
+		Prepublish:  prepublish,
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Start rolls the keys, so that the zone has keys once it is served, and
+// keeps them rolled until Stop is called.
+func (m *KeyManager) Start() error {
+	if err := m.Roll(time.Now()); err != nil {
+		return fmt.Errorf("failed to roll DNSSEC keys of %s: %v", m.Zone, err)
+	}
+	m.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(keyCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				if err := m.Roll(now); err != nil {
+					log.Errorf("failed to roll DNSSEC keys of %s: %v", m.Zone, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops rolling the keys.
+func (m *KeyManager) Stop() error {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	return nil
+}
+
+// Roll brings the keys up to date with the schedule at now: it generates
+// keys and successors that are due, removes keys that are no longer
+// published, persists the schedule and updates the signer.
+func (m *KeyManager) Roll(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+
+	m.holdKSKs(now)
+	kept := make([]*managedKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		if !now.Before(key.Remove) {
+			log.Infof("removing DNSSEC key %s", key.Base)
+			os.Remove(filepath.Join(m.Dir, key.Base+".key"))
+			os.Remove(filepath.Join(m.Dir, key.Base+".private"))
+			continue
+		}
+		kept = append(kept, key)
+	}
+	m.keys = kept
+
+	for _, ksk := range []bool{false, true} {
+		if err := m.rollRole(ksk, now); err != nil {
+			return err
+		}
+	}
+	if err := m.save(); err != nil {
+		return err
+	}
+	if err := m.writeDS(now); err != nil {
+		return err
+	}
+
+	if m.DNSSEC == nil {
+		return nil
+	}
+	active, published := m.keySet(now)
+	m.DNSSEC.SetKeys(active, published)
+	return nil
+}
+
+// rollRole generates the key of a role if there is none active, and its
+// successor once the current key is within Prepublish of retiring.
+func (m *KeyManager) rollRole(ksk bool, now time.Time) error {
+	lifetime := m.ZSKLifetime
+	if ksk {
+		lifetime = m.KSKLifetime
+	}
+	var current *managedKey
+	for _, key := range m.keys {
+		if key.KSK == ksk && !now.Before(key.Activate) && now.Before(key.Retire) && (current == nil || key.Retire.After(current.Retire)) {
+			current = key
+		}
+	}
+	if current == nil {
+		_, err := m.generate(ksk, now, now, lifetime)
+		return err
+	}
+	if now.Before(current.Retire.Add(-m.Prepublish)) {
+		return nil
+	}
+	for _, key := range m.keys {
+		if key.KSK == ksk && key.Retire.After(current.Retire) {
+			// Successor already scheduled
+			return nil
+		}
+	}
+	if ksk {
+		// Double signature: the successor signs from now
+		_, err := m.generate(ksk, now, now, lifetime)
+		return err
+	}
+	// Pre-publish: the successor signs once the current key retires
+	_, err := m.generate(ksk, now, current.Retire, current.Retire.Sub(now)+lifetime)
+	return err
+}
+
+// holdKSKs keeps the key signing keys that are due to retire signing until
+// the DS record of their successor has been confirmed at the parent for
+// Prepublish.
+func (m *KeyManager) holdKSKs(now time.Time) {
+	confirmed := false
+	for _, key := range m.keys {
+		if !key.KSK || now.Before(key.Retire) {
+			continue
+		}
+		var successor *managedKey
+		for _, other := range m.keys {
+			if other.KSK && other.Retire.After(key.Retire) && (successor == nil || other.Publish.Before(successor.Publish)) {
+				successor = other
+			}
+		}
+		if successor == nil {
+			continue
+		}
+		if successor.DSSeen.IsZero() && !confirmed {
+			m.confirmDS(now)
+			confirmed = true
+		}
+		hold := now.Add(keyCheckInterval)
+		if !successor.DSSeen.IsZero() {
+			hold = successor.DSSeen.Add(m.Prepublish)
+		}
+		if successor.DSSeen.IsZero() {
+			log.Infof("keeping DNSSEC key %s until the DS record of %s is at the parent of %s", key.Base, successor.Base, m.Zone)
+		}
+		if hold.After(key.Retire) {
+			key.Retire = hold
+			key.Remove = hold
+		}
+	}
+}
+
+// confirmDS records the key signing keys whose DS records are at the
+// parent, as confirmed by the operator or the parent resolver.
+func (m *KeyManager) confirmDS(now time.Time) {
+	confirmFile := filepath.Join(m.Dir, "dspublished-"+m.Zone)
+	if _, err := os.Stat(confirmFile); err == nil {
+		for _, key := range m.keys {
+			if key.KSK && key.DSSeen.IsZero() && !now.Before(key.Publish) {
+				key.DSSeen = now
+				log.Infof("DS record of DNSSEC key %s confirmed by %s", key.Base, confirmFile)
+			}
+		}
+		os.Remove(confirmFile)
+		return
+	}
+	if m.Parent == "" {
+		return
+	}
+	dsRrs, err := m.parentDS()
+	if err != nil {
+		log.Warnf("failed to query the DS records of %s: %v", m.Zone, err)
+		return
+	}
+	for _, key := range m.keys {
+		if !key.KSK || !key.DSSeen.IsZero() {
+			continue
+		}
+		for _, ds := range dsRrs {
+			expected := key.key.DNSKEY.ToDS(ds.DigestType)
+			if expected != nil && ds.KeyTag == expected.KeyTag && ds.Algorithm == expected.Algorithm && strings.EqualFold(ds.Digest, expected.Digest) {
+				key.DSSeen = now
+				log.Infof("DS record of DNSSEC key %s is at the parent of %s", key.Base, m.Zone)
+				break
+			}
+		}
+	}
+}
+
+// parentDS asks the parent resolver for the DS records of the zone.
+func (m *KeyManager) parentDS() ([]*dns.DS, error) {
+	r := new(dns.Msg)
+	r.SetQuestion(m.Zone, dns.TypeDS)
+	c := &dns.Client{Timeout: dsQueryTimeout}
+	resp, _, err := c.Exchange(r, m.Parent)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("DS query answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	results := make([]*dns.DS, 0)
+	for _, rr := range resp.Answer {
+		if ds, ok := rr.(*dns.DS); ok {
+			results = append(results, ds)
+		}
+	}
+	return results, nil
+}
+
+// generate creates a key that is published at publish and signs from
+// activate for lifetime from publish, and writes it to the directory.
+func (m *KeyManager) generate(ksk bool, publish time.Time, activate time.Time, lifetime time.Duration) (*managedKey, error) {
+	flags := uint16(dns.ZONE)
+	if ksk {
+		flags |= dns.SEP
+	}
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: m.Zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: defaultTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: m.Algorithm,
+	}
+	privKey, err := dnskey.Generate(keyBits(m.Algorithm))
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("algorithm %d does not sign", m.Algorithm)
+	}
+
+	base := fmt.Sprintf("K%s+%03d+%05d", m.Zone, m.Algorithm, dnskey.KeyTag())
+	if err := writeFile(filepath.Join(m.Dir, base+".private"), dnskey.PrivateKeyString(privKey)); err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(m.Dir, base+".key"), dnskey.String()+"\n"); err != nil {
+		return nil, err
+	}
+
+	retire := publish.Add(lifetime)
+	remove := retire.Add(m.Prepublish)
+	if ksk {
+		remove = retire
+	}
+	key := &managedKey{
+		Base:     base,
+		KSK:      ksk,
+		Publish:  publish,
+		Activate: activate,
+		Retire:   retire,
+		Remove:   remove,
+		key:      &SigningKey{DNSKEY: dnskey, Tag: dnskey.KeyTag(), signer: signer},
+	}
+	m.keys = append(m.keys, key)
+	log.Infof("generated DNSSEC key %s, active from %s until %s", base, activate.UTC().Format(time.RFC3339), retire.UTC().Format(time.RFC3339))
+	return key, nil
+}
+
+// keySet returns the keys that sign at now and those that are only
+// published.
+func (m *KeyManager) keySet(now time.Time) ([]*SigningKey, []*SigningKey) {
+	active := make([]*SigningKey, 0)
+	published := make([]*SigningKey, 0)
+	for _, key := range m.keys {
+		switch {
+		case !now.Before(key.Activate) && now.Before(key.Retire):
+			active = append(active, key.key)
+		case !now.Before(key.Publish) && now.Before(key.Remove):
+			published = append(published, key.key)
+		}
+	}
+	return active, published
+}
+
+// DS returns the DS records of the published key signing keys, which the
+// parent zone must serve.
+func (m *KeyManager) DS(now time.Time) []dns.RR {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dsRecords(now)
+}
+
+func (m *KeyManager) dsRecords(now time.Time) []dns.RR {
+	results := make([]dns.RR, 0)
+	for _, key := range m.keys {
+		if key.KSK && !now.Before(key.Publish) && now.Before(key.Remove) {
+			results = append(results, key.key.DNSKEY.ToDS(dns.SHA256))
+		}
+	}
+	return results
+}
+
+// writeDS writes the DS records to dsset-<zone> and logs them when they
+// change.
+func (m *KeyManager) writeDS(now time.Time) error {
+	var text strings.Builder
+	for _, ds := range m.dsRecords(now) {
+		text.WriteString(ds.String())
+		text.WriteString("\n")
+	}
+	if text.String() == m.ds {
+		return nil
+	}
+	if err := writeFile(filepath.Join(m.Dir, "dsset-"+m.Zone), text.String()); err != nil {
+		return err
+	}
+	m.ds = text.String()
+	log.Infof("DS records for the parent of %s:\n%s", m.Zone, m.ds)
+	return nil
+}
+
+// load reads the key schedule and keys from the directory.
+func (m *KeyManager) load() error {
+	data, err := os.ReadFile(filepath.Join(m.Dir, keyStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var keys []*managedKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid %s: %v", keyStateFile, err)
+	}
+	for _, key := range keys {
+		if key.key, err = LoadSigningKey(filepath.Join(m.Dir, key.Base)); err != nil {
+			return err
+		}
+		if !strings.EqualFold(key.key.DNSKEY.Hdr.Name, m.Zone) {
+			return fmt.Errorf("key %s is not for %s", key.Base, m.Zone)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Publish.Before(keys[j].Publish) })
+	m.keys = keys
+	return nil
+}
+
+// save writes the key schedule to the directory.
+func (m *KeyManager) save() error {
+	data, err := json.MarshalIndent(m.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(m.Dir, keyStateFile), string(data)+"\n")
+}
+
+// writeFile replaces a file atomically.
+func writeFile(path string, content string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// keyBits returns the key size to generate for an algorithm.
+func keyBits(algorithm uint8) int {
+	switch algorithm {
+	case dns.RSASHA256, dns.RSASHA512:
+		return 2048
+	case dns.ECDSAP384SHA384:
+		return 384
+	default:
+		return 256
+	}
+}
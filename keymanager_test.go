@@ -0,0 +1,158 @@
+package near
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestKeyManagerRoll(t *testing.T) {
+	dir := t.TempDir()
+	day := 24 * time.Hour
+	m, err := NewKeyManager(dir, "near.link", dns.ECDSAP256SHA256, 10*day, 40*day, 2*day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDNSSEC([]*SigningKey{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.DNSSEC = d
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		offset    time.Duration
+		zsks      int
+		ksks      int
+		published int
+		ds        int
+	}{
+		// Initial keys
+		{0, 1, 1, 0, 1},
+		// ZSK successor published ahead of use
+		{8*day + time.Hour, 1, 1, 1, 1},
+		// ZSK successor takes over, the old key stays published
+		{10*day + time.Hour, 1, 1, 1, 1},
+		// Old ZSK removed
+		{12*day + time.Hour, 1, 1, 0, 1},
+		// KSK successor signs alongside the current key
+		{38*day + time.Hour, 1, 2, 0, 2},
+		// Old KSK kept until the new DS record is at the parent
+		{40*day + time.Hour, 1, 2, 0, 2},
+		{50*day + time.Hour, 1, 2, 0, 2},
+	}
+	for i, tt := range tests {
+		now := start.Add(tt.offset)
+		if err := m.Roll(now); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		zsks, ksks := 0, 0
+		for _, key := range d.Keys() {
+			if key.isKSK() {
+				ksks++
+			} else {
+				zsks++
+			}
+		}
+		published := len(d.DNSKEYs("near.link.", 3600)) - zsks - ksks
+		if zsks != tt.zsks || ksks != tt.ksks || published != tt.published {
+			t.Errorf("Test %d: %d ZSKs, %d KSKs and %d published keys (expected %d, %d and %d)", i, zsks, ksks, published, tt.zsks, tt.ksks, tt.published)
+		}
+		if ds := m.DS(now); len(ds) != tt.ds {
+			t.Errorf("Test %d: %d DS records (expected %d)", i, len(ds), tt.ds)
+		}
+	}
+
+	// The operator confirms the DS record; the old KSK is removed after
+	// the prepublication period
+	if err := os.WriteFile(filepath.Join(dir, "dspublished-near.link."), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		offset time.Duration
+		ksks   int
+	}{
+		{50*day + 2*time.Hour, 2},
+		{52*day + time.Hour, 2},
+		{52*day + 3*time.Hour, 1},
+	} {
+		now := start.Add(tt.offset)
+		if err := m.Roll(now); err != nil {
+			t.Fatalf("Confirmed test %d: %v", i, err)
+		}
+		if ksks := len(m.DS(now)); ksks != tt.ksks {
+			t.Errorf("Confirmed test %d: %d KSKs (expected %d)", i, ksks, tt.ksks)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dspublished-near.link.")); !os.IsNotExist(err) {
+		t.Errorf("confirmation file was not consumed: %v", err)
+	}
+
+	// The schedule survives a restart
+	reloaded, err := NewKeyManager(dir, "near.link.", dns.ECDSAP256SHA256, 10*day, 40*day, 2*day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.keys) != len(m.keys) {
+		t.Fatalf("reloaded %d keys (expected %d)", len(reloaded.keys), len(m.keys))
+	}
+	for i := range m.keys {
+		if reloaded.keys[i].key.Tag != m.keys[i].key.Tag || !reloaded.keys[i].Retire.Equal(m.keys[i].Retire) {
+			t.Errorf("reloaded key %s differs", reloaded.keys[i].Base)
+		}
+	}
+}
+
+func TestKeyManagerParentDS(t *testing.T) {
+	day := 24 * time.Hour
+	m, err := NewKeyManager(t.TempDir(), "near.link", dns.ECDSAP256SHA256, 10*day, 40*day, 2*day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := m.Roll(start); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Roll(start.Add(38 * day)); err != nil {
+		t.Fatal(err)
+	}
+	successor := m.keys[len(m.keys)-1]
+
+	// The parent serves the DS record of the successor once it is replaced
+	ds := successor.key.DNSKEY.ToDS(dns.SHA256)
+	var replaced atomic.Bool
+	addr, stop := startNotifyServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(r)
+		if replaced.Load() {
+			a.Answer = append(a.Answer, ds)
+		}
+		w.WriteMsg(a)
+	}))
+	defer stop()
+	m.Parent = addr
+
+	if err := m.Roll(start.Add(41 * day)); err != nil {
+		t.Fatal(err)
+	}
+	if ksks := len(m.DS(start.Add(41 * day))); ksks != 2 {
+		t.Errorf("%d KSKs before the DS record is replaced (expected 2)", ksks)
+	}
+	replaced.Store(true)
+	if err := m.Roll(start.Add(42 * day)); err != nil {
+		t.Fatal(err)
+	}
+	if !successor.DSSeen.Equal(start.Add(42 * day)) {
+		t.Errorf("DS record of the successor seen at %v", successor.DSSeen)
+	}
+	if err := m.Roll(start.Add(44*day + time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ksks := len(m.DS(start.Add(44*day + time.Hour))); ksks != 1 {
+		t.Errorf("%d KSKs after the DS record is replaced (expected 1)", ksks)
+	}
+}
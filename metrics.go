@@ -0,0 +1,19 @@
+package near
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// invalidRecordsCount is the number of invalid records read from the
+	// contract, by account and reason.
+	invalidRecordsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "near",
+		Name:      "invalid_records_total",
+		Help:      "Counter of invalid records read from the contract.",
+	}, []string{"account", "reason"})
+)
@@ -3,13 +3,11 @@ package near
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
-	b64 "encoding/base64"
-
 	nearclient "github.com/CrossChainLabs/near-api-go"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
@@ -24,36 +22,145 @@ type NEAR struct {
 	Client              *nearclient.Client
 	NEARDNS             string
 	NEARLinkNameServers []string
+	// NameServerAddresses holds the addresses of NEARLinkNameServers, by
+	// fully-qualified name, to serve as glue.
+	NameServerAddresses map[string][]string
 	IPFSGatewayAs       []string
 	IPFSGatewayAAAAs    []string
+	GeoMap              *GeoMap
+	GatewayPools        map[string]*GatewayPool
+	GatewayResolver     *GatewayResolver
+	GatewayCNAME        bool
+	SubdomainGateway    string
+	HTTPS               *HTTPSConfig
+	Profile             *ContractProfile
+	TTL                 *TTLPolicy
+	SOA                 *SOAConfig
+	BlockHeight         *BlockHeight
+	ApexAs              []string
+	ApexAAAAs           []string
+	ApexTXTs            []string
+	DNSSEC              *DNSSEC
+	KeyManager          *KeyManager
+	OwnerKeys           *OwnerKeys
+	ZoneTransfer        *ZoneTransfer
+	StateSync           *StateSync
+	Delegations         *DelegationCache
+	RecordTypes         *RecordTypesCache
+	// Zone is the served zone, such as near.link., if it is not near.
+	Zone string
+
+	// clientIP is the address used to select a gateway pool for the
+	// request being served.
+	clientIP net.IP
+	// gatewaySelected, if set, records whether a gateway pool was selected
+	// for the client in the request being served.
+	gatewaySelected *bool
 }
 
+// IsAuthoritative returns true for the zone apex, NEAR accounts and the
+// plugin's own nameservers.  Names with a leading underscore or wildcard
+// label are record keys of an account, such as _dmarc or _matrix._tcp, so
+// they are not accounts themselves.
 func (n NEAR) IsAuthoritative(domain string) bool {
-	return true
+	if domain == zoneApex || n.isNameServer(domain) {
+		return true
+	}
+	return strings.HasSuffix(domain, "."+zoneApex) && !strings.HasPrefix(domain, "_") && !strings.HasPrefix(domain, "*.")
 }
 
+// HasRecords returns true if the name has a content hash or any records in
+// the contract.  If that cannot be determined the name is assumed to have
+// records, so that it is never wrongly denied.
 func (n NEAR) HasRecords(domain string, name string) (bool, error) {
-	return true, nil
+	if n.isNameServer(name) {
+		return true, nil
+	}
+	if domain == zoneApex {
+		// Names below the apex that are not accounts do not exist
+		return name == domain, nil
+	}
+	if !validAccount(domain) {
+		return false, nil
+	}
+	if name != domain {
+		// Record keys cannot be enumerated
+		return true, nil
+	}
+	types, contentHash, err := n.accountTypes(domain)
+	if err != nil {
+		return true, nil
+	}
+	return contentHash || len(types) > 0, nil
+}
+
+// validAccount returns true if the domain is a valid NEAR account.  Account
+// IDs consist of lowercase letters, digits and the separators '-', '_' and
+// '.', so names such as wildcards are never looked up in the contract.
+func validAccount(domain string) bool {
+	account := strings.TrimSuffix(domain, ".near.")
+	if account == "" || account == domain {
+		return false
+	}
+	for _, c := range account {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
 }
 
 func (n NEAR) Query(domain string, name string, qtype uint16, do bool) ([]dns.RR, error) {
 	results := make([]dns.RR, 0)
 
+	if n.isNameServer(name) {
+		// Our own nameservers are answered from the configuration
+		return n.handleGlue(name, qtype), nil
+	}
+	if !dns.IsSubDomain(domain, name) {
+		// Glue for other nameservers is not ours to serve
+		return results, nil
+	}
+	if domain == zoneApex {
+		return n.handleApex(name, qtype)
+	}
+	if !validAccount(domain) {
+		return results, nil
+	}
+	if qtype == dns.TypeSOA {
+		// Accounts are names in the zone; only the apex has an SOA
+		return results, nil
+	}
+	if name != domain {
+		// Underscore names only hold records published under their key
+		return n.handleRecords(name, domain, qtype)
+	}
+
 	var contentHash []byte
 	hasContentHash := false
 	var err error
-	if qtype == dns.TypeSOA ||
-		qtype == dns.TypeNS ||
-		qtype == dns.TypeTXT ||
-		qtype == dns.TypeA ||
-		qtype == dns.TypeAAAA {
+	if qtype == dns.TypeCNAME {
+		// A published CNAME takes precedence over a gateway CNAME
+		results, err = n.handleRecords(name, domain, qtype)
+		if err != nil || len(results) > 0 || (!n.GatewayCNAME && n.SubdomainGateway == "") {
+			return results, err
+		}
+	}
+	switch qtype {
+	case dns.TypeNS, dns.TypeTXT, dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB, dns.TypeCNAME:
 		contentHash, err = n.obtainContentHash(name, domain)
 		hasContentHash = err == nil && bytes.Compare(contentHash, emptyContentHash) > 0
+	case dns.TypeDS:
+		return n.handleDS(name, domain)
+	case dns.TypeDNSKEY:
+		// The keys of an account are served by its own nameservers
+		return results, nil
+	default:
+		// Any other type is served as published in the contract
+		return n.handleRecords(name, domain, qtype)
 	}
 	if hasContentHash {
 		switch qtype {
-		case dns.TypeSOA:
-			results, err = n.handleSOA(name, domain, contentHash)
 		case dns.TypeNS:
 			results, err = n.handleNS(name, domain, contentHash)
 		case dns.TypeTXT:
@@ -62,32 +169,20 @@ func (n NEAR) Query(domain string, name string, qtype uint16, do bool) ([]dns.RR
 			results, err = n.handleA(name, domain, contentHash)
 		case dns.TypeAAAA:
 			results, err = n.handleAAAA(name, domain, contentHash)
+		case dns.TypeCNAME:
+			results, err = n.handleCNAME(name, domain, contentHash)
+		case dns.TypeHTTPS, dns.TypeSVCB:
+			results, err = n.handleHTTPS(name, domain, contentHash, qtype)
 		}
 	}
 
 	return results, err
 }
 
-func (n NEAR) handleSOA(name string, domain string, contentHash []byte) ([]dns.RR, error) {
-	results := make([]dns.RR, 0)
-	if len(n.NEARLinkNameServers) > 0 {
-		// Create a synthetic SOA record
-		now := time.Now()
-		ser := ((now.Hour()*3600 + now.Minute()) * 100) / 86400
-		dateStr := fmt.Sprintf("%04d%02d%02d%02d", now.Year(), now.Month(), now.Day(), ser)
-		result, err := dns.NewRR(fmt.Sprintf("%s 10800 IN SOA %s hostmaster.%s %s 3600 600 1209600 300", n.NEARLinkNameServers[0], name, name, dateStr))
-		if err != nil {
-			return results, err
-		}
-		results = append(results, result)
-	}
-	return results, nil
-}
-
 func (n NEAR) handleNS(name string, domain string, contentHash []byte) ([]dns.RR, error) {
 	results := make([]dns.RR, 0)
 	for _, nameserver := range n.NEARLinkNameServers {
-		result, err := dns.NewRR(fmt.Sprintf("%s 3600 IN NS %s", domain, nameserver))
+		result, err := dns.NewRR(fmt.Sprintf("%s %d IN NS %s", domain, n.synthesizedTTL(dns.TypeNS, false), nameserver))
 		if err != nil {
 			return results, err
 		}
@@ -102,17 +197,10 @@ func (n NEAR) handleTXT(name string, domain string, contentHash []byte) ([]dns.R
 	txtRRSet, err := n.obtainTXTRRSet(name, domain)
 	if err == nil && len(txtRRSet) != 0 {
 		// We have a TXT rrset; use it
-		offset := 0
-		for offset < len(txtRRSet) {
-			var result dns.RR
-			result, offset, err = dns.UnpackRR(txtRRSet, offset)
-			if err == nil {
-				results = append(results, result)
-			}
-		}
+		results = append(results, n.contractRRSet(domain, txtRRSet, name, dns.TypeTXT)...)
 	}
 
-	result, err := dns.NewRR(fmt.Sprintf("%s 3600 IN TXT \"contenthash=0x%s\"", name, contentHash))
+	result, err := dns.NewRR(fmt.Sprintf("%s %d IN TXT \"contenthash=0x%s\"", name, n.synthesizedTTL(dns.TypeTXT, false), contentHash))
 	if err != nil {
 		return results, err
 	}
@@ -127,18 +215,14 @@ func (n NEAR) handleA(name string, domain string, contentHash []byte) ([]dns.RR,
 	aRRSet, err := n.obtainARRSet(name, domain)
 	if err == nil && len(aRRSet) != 0 {
 		// We have an A rrset; use it
-		offset := 0
-		for offset < len(aRRSet) {
-			var result dns.RR
-			result, offset, err = dns.UnpackRR(aRRSet, offset)
-			if err == nil {
-				results = append(results, result)
-			}
-		}
-	} else {
-		// We have a content hash but no A record; use the default
-		for i := range n.IPFSGatewayAs {
-			result, err := dns.NewRR(fmt.Sprintf("%s 3600 IN A %s", name, n.IPFSGatewayAs[i]))
+		results = n.contractRRSet(domain, aRRSet, name, dns.TypeA)
+	}
+	if len(results) == 0 {
+		// We have a content hash but no A record; use the gateway pool
+		gateways := n.gatewayPool().As
+		ttl := n.synthesizedTTL(dns.TypeA, true)
+		for i := range gateways {
+			result, err := dns.NewRR(fmt.Sprintf("%s %d IN A %s", name, ttl, gateways[i]))
 			if err != nil {
 				return results, err
 			}
@@ -155,18 +239,14 @@ func (n NEAR) handleAAAA(name string, domain string, contentHash []byte) ([]dns.
 	aaaaRRSet, err := n.obtainAAAARRSet(name, domain)
 	if err == nil && len(aaaaRRSet) != 0 {
 		// We have an AAAA rrset; use it
-		offset := 0
-		for offset < len(aaaaRRSet) {
-			var result dns.RR
-			result, offset, err = dns.UnpackRR(aaaaRRSet, offset)
-			if err == nil {
-				results = append(results, result)
-			}
-		}
-	} else {
-		// We have a content hash but no AAAA record; use the default
-		for i := range n.IPFSGatewayAAAAs {
-			result, err := dns.NewRR(fmt.Sprintf("%s 3600 IN AAAA %s", name, n.IPFSGatewayAAAAs[i]))
+		results = n.contractRRSet(domain, aaaaRRSet, name, dns.TypeAAAA)
+	}
+	if len(results) == 0 {
+		// We have a content hash but no AAAA record; use the gateway pool
+		gateways := n.gatewayPool().AAAAs
+		ttl := n.synthesizedTTL(dns.TypeAAAA, true)
+		for i := range gateways {
+			result, err := dns.NewRR(fmt.Sprintf("%s %d IN AAAA %s", name, ttl, gateways[i]))
 			if err != nil {
 				log.Warnf("error creating %s AAAA RR: %v", name, err)
 			}
@@ -176,30 +256,123 @@ func (n NEAR) handleAAAA(name string, domain string, contentHash []byte) ([]dns.
 	return results, nil
 }
 
+func (n NEAR) handleCNAME(name string, domain string, contentHash []byte) ([]dns.RR, error) {
+	results := make([]dns.RR, 0)
+
+	// Addresses in the contract take precedence over the gateway
+	aRRSet, err := n.obtainARRSet(name, domain)
+	if err == nil && len(aRRSet) != 0 {
+		return results, nil
+	}
+	aaaaRRSet, err := n.obtainAAAARRSet(name, domain)
+	if err == nil && len(aaaaRRSet) != 0 {
+		return results, nil
+	}
+
+	var target string
+	switch {
+	case n.SubdomainGateway != "":
+		// Point at the content on a subdomain gateway
+		hash, err := decodeContentHash(contentHash)
+		if err != nil {
+			log.Warnf("failed to decode content hash of %s: %v", name, err)
+			return results, nil
+		}
+		if len(hash.String()) > maxLabelLength {
+			// Long CIDs do not fit in a label; the gateway addresses are
+			// answered instead
+			log.Debugf("content hash of %s is too long for a subdomain gateway", name)
+			return results, nil
+		}
+		target = fmt.Sprintf("%s.%s.%s", hash, hash.Namespace, n.SubdomainGateway)
+	case n.GatewayResolver != nil && len(n.GatewayResolver.Names) > 0:
+		target = n.GatewayResolver.Names[0]
+	default:
+		return results, nil
+	}
+
+	result, err := dns.NewRR(fmt.Sprintf("%s %d IN CNAME %s", name, n.synthesizedTTL(dns.TypeCNAME, true), target))
+	if err != nil {
+		return results, err
+	}
+	results = append(results, result)
+
+	return results, nil
+}
+
 // ServeDNS implements the plugin.Handler interface.
 func (n NEAR) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
+	qname := strings.ToLower(dns.Fqdn(state.Name()))
+	name := n.internalName(qname)
+	if !n.IsAuthoritative(highestAuthoritativeDomain(n, name)) {
+		return plugin.NextOrFailure(n.Name(), n.Next, ctx, w, r)
+	}
+	lookupState := state
+	if name != qname {
+		// Look up the name below the internal apex
+		req := r.Copy()
+		req.Question[0].Name = name
+		lookupState = request.Request{W: w, Req: req}
+	}
+
+	// n is a copy, so the client address is local to this request
+	var ecs *dns.EDNS0_SUBNET
+	n.clientIP, ecs = clientSubnet(state)
+	gatewaySelected := false
+	n.gatewaySelected = &gatewaySelected
 
 	a := new(dns.Msg)
 	a.SetReply(r)
 	a.Compress = true
 	a.Authoritative = true
 	var result Result
-	a.Answer, a.Ns, a.Extra, result = Lookup(n, state)
+	a.Answer, a.Ns, a.Extra, result = Lookup(n, lookupState)
+	if name != qname {
+		n.externalNames(a.Answer)
+		n.externalNames(a.Ns)
+		n.externalNames(a.Extra)
+	}
+	if n.DNSSEC != nil && state.Do() && result != ServerFailure {
+		var err error
+		if result, err = n.signResponse(a, result, state.QType(), time.Now()); err != nil {
+			log.Errorf("failed to sign response for %s: %v", state.Name(), err)
+			return dns.RcodeServerFailure, err
+		}
+	}
+	if ecs != nil && len(n.GatewayPools) > 0 {
+		// Tell the resolver how widely it can cache the answer
+		o := new(dns.OPT)
+		o.Hdr.Name = "."
+		o.Hdr.Rrtype = dns.TypeOPT
+		o.Option = append(o.Option, n.ecsScope(ecs, gatewaySelected))
+		a.Extra = append(a.Extra, o)
+	}
 	switch result {
 	case Success:
 		state.SizeAndDo(a)
 		w.WriteMsg(a)
 		return dns.RcodeSuccess, nil
 	case NoData:
-		if n.Next == nil {
-			state.SizeAndDo(a)
-			w.WriteMsg(a)
-			return dns.RcodeSuccess, nil
-		}
-		return plugin.NextOrFailure(n.Name(), n.Next, ctx, w, r)
+		state.SizeAndDo(a)
+		w.WriteMsg(a)
+		return dns.RcodeSuccess, nil
+	case Delegation:
+		// Referrals are not authoritative for the delegated names
+		a.Authoritative = false
+		state.SizeAndDo(a)
+		w.WriteMsg(a)
+		return dns.RcodeSuccess, nil
 	case NameError:
 		a.Rcode = dns.RcodeNameError
+		state.SizeAndDo(a)
+		w.WriteMsg(a)
+		return dns.RcodeNameError, nil
+	case NameTooLong:
+		a.Rcode = dns.RcodeYXDomain
+		state.SizeAndDo(a)
+		w.WriteMsg(a)
+		return dns.RcodeYXDomain, nil
 	case ServerFailure:
 		return dns.RcodeServerFailure, nil
 	}
@@ -209,103 +382,44 @@ func (n NEAR) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (i
 }
 
 func (n NEAR) obtainARRSet(name string, domain string) ([]byte, error) {
-	nearDomain := strings.TrimSuffix(domain, ".near.")
-	params := "{\"account_id\": \"" + nearDomain + "\"}"
-	paramsEnc := b64.StdEncoding.EncodeToString([]byte(params))
-
-	resp, err := n.Client.FunctionCall(n.NEARDNS, "get_a", paramsEnc)
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	var byte_result []byte
-
-	if err := json.Unmarshal(resp.Result, &byte_result); err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	dec := string(byte_result)
-	dec = strings.TrimPrefix(dec, "\"")
-	dec = strings.TrimSuffix(dec, "\"")
-
-	return []byte(dec), nil
+	return n.view(kindA, domain, dns.TypeA, "")
 }
 
 func (n NEAR) obtainAAAARRSet(name string, domain string) ([]byte, error) {
-	nearDomain := strings.TrimSuffix(domain, ".near.")
-	params := "{\"account_id\": \"" + nearDomain + "\"}"
-	paramsEnc := b64.StdEncoding.EncodeToString([]byte(params))
-
-	resp, err := n.Client.FunctionCall(n.NEARDNS, "get_aaaa", paramsEnc)
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	var byte_result []byte
-
-	if err := json.Unmarshal(resp.Result, &byte_result); err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	dec := string(byte_result)
-	dec = strings.TrimPrefix(dec, "\"")
-	dec = strings.TrimSuffix(dec, "\"")
-
-	return []byte(dec), nil
+	return n.view(kindAAAA, domain, dns.TypeAAAA, "")
 }
 
 func (n NEAR) obtainContentHash(name string, domain string) ([]byte, error) {
-	nearDomain := strings.TrimSuffix(domain, ".near.")
-	params := "{\"account_id\": \"" + nearDomain + "\"}"
-	paramsEnc := b64.StdEncoding.EncodeToString([]byte(params))
-
-	resp, err := n.Client.FunctionCall(n.NEARDNS, "get_content_hash", paramsEnc)
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	var byte_result []byte
-
-	if err := json.Unmarshal(resp.Result, &byte_result); err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	dec := string(byte_result)
-	dec = strings.TrimPrefix(dec, "\"")
-	dec = strings.TrimSuffix(dec, "\"")
-
-	return []byte(dec), nil
+	return n.view(kindContentHash, domain, dns.TypeNone, "")
 }
 
 func (n NEAR) obtainTXTRRSet(name string, domain string) ([]byte, error) {
-	nearDomain := strings.TrimSuffix(domain, ".near.")
-	params := "{\"account_id\": \"" + nearDomain + "\"}"
-	paramsEnc := b64.StdEncoding.EncodeToString([]byte(params))
+	return n.view(kindTXT, domain, dns.TypeTXT, "")
+}
 
-	resp, err := n.Client.FunctionCall(n.NEARDNS, "get_txt", paramsEnc)
+func (n NEAR) obtainRecordTypes(name string, domain string) ([]uint16, error) {
+	if n.StateSync != nil {
+		if types, ok := n.StateSync.RecordTypes(domain); ok {
+			return types, nil
+		}
+	}
+	result, err := n.call(kindTypes, domain, dns.TypeNone, "")
 	if err != nil {
-		log.Error(err)
 		return nil, err
 	}
+	return parseRecordTypes(result)
+}
 
-	var byte_result []byte
-
-	if err := json.Unmarshal(resp.Result, &byte_result); err != nil {
-		log.Error(err)
-		return nil, err
-	}
+func (n NEAR) obtainHTTPSRRSet(name string, domain string) ([]byte, error) {
+	return n.view(kindHTTPS, domain, dns.TypeHTTPS, "")
+}
 
-	dec := string(byte_result)
-	dec = strings.TrimPrefix(dec, "\"")
-	dec = strings.TrimSuffix(dec, "\"")
+func (n NEAR) obtainDSRRSet(name string, domain string) ([]byte, error) {
+	return n.view(kindDS, domain, dns.TypeDS, "")
+}
 
-	return []byte(dec), nil
+func (n NEAR) obtainDNSKEYRRSet(name string, domain string) ([]byte, error) {
+	return n.view(kindDNSKEY, domain, dns.TypeDNSKEY, "")
 }
 
 // Name implements the Handler interface.
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"context"
 	golog "log"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	nearclient "github.com/CrossChainLabs/near-api-go"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
 
@@ -35,3 +39,225 @@ func TestExample(t *testing.T) {
 		t.Errorf("Failed to print '%s', got %s", "example 1", a)
 	}
 }
+
+func TestAccountDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		key    string
+	}{
+		{"alice.near.", "alice.near.", ""},
+		{"sub.alice.near.", "sub.alice.near.", ""},
+		{"_dmarc.alice.near.", "alice.near.", "_dmarc"},
+		{"_matrix._tcp.alice.near.", "alice.near.", "_matrix._tcp"},
+		{"_acme-challenge.sub.alice.near.", "sub.alice.near.", "_acme-challenge"},
+		{"*.alice.near.", "alice.near.", "*"},
+		{"near.", "near.", ""},
+		{"*.near.", "near.", "*"},
+		{"_dmarc.near.", "near.", "_dmarc"},
+		{"example.org.", ".", ""},
+	}
+
+	n := NEAR{}
+	for _, tt := range tests {
+		domain := highestAuthoritativeDomain(n, tt.name)
+		if domain != tt.domain {
+			t.Errorf("Failure: %v => %v (expected %v)\n", tt.name, domain, tt.domain)
+			continue
+		}
+		if key := recordKey(tt.name, domain); domain != "." && key != tt.key {
+			t.Errorf("Failure: %v => key %v (expected %v)\n", tt.name, key, tt.key)
+		}
+	}
+}
+
+func TestValidAccount(t *testing.T) {
+	tests := []struct {
+		domain string
+		valid  bool
+	}{
+		{"alice.near.", true},
+		{"sub-1.alice_b.near.", true},
+		{"*.near.", false},
+		{"near.", false},
+		{"example.org.", false},
+		{"Alice.near.", false},
+	}
+	for _, tt := range tests {
+		if valid := validAccount(tt.domain); valid != tt.valid {
+			t.Errorf("Failure: %v => %v (expected %v)\n", tt.domain, valid, tt.valid)
+		}
+	}
+}
+
+// testContentHash is the content hash of an IPFS website.
+const testContentHash = "e3010170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f"
+
+// indexedNEAR creates a NEAR plugin that answers from a state sync index of
+// records keyed as in the contract state, such as "alice:A", without a NEAR
+// node.
+func indexedNEAR(t *testing.T, records map[string]string) NEAR {
+	s := NewStateSync("", "dns.near", nil)
+	s.accounts = make(map[string]*indexedAccount)
+	for key, value := range records {
+		record, err := parseStateKey(nil, []byte(key))
+		if err != nil {
+			t.Fatalf("invalid state key %s: %v", key, err)
+		}
+		record.value = []byte(value)
+		index(s.accounts, record)
+	}
+	s.height, s.head, s.synced = 1, 1, time.Now()
+	return NEAR{
+		Next:                test.ErrorHandler(),
+		NEARDNS:             "dns.near",
+		NEARLinkNameServers: []string{"ns1.near.link."},
+		StateSync:           s,
+	}
+}
+
+// serve answers a query with the plugin and returns the response.
+func serve(t *testing.T, n NEAR, name string, qtype uint16, do bool) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	if do {
+		r.SetEdns0(4096, true)
+	}
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := n.ServeDNS(context.TODO(), rec, r); err != nil {
+		t.Fatalf("query for %s failed: %v", name, err)
+	}
+	if rec.Msg == nil {
+		t.Fatalf("no answer for %s", name)
+	}
+	return rec.Msg
+}
+
+// hasRecord returns true if the records contain one with the name, type and
+// data of the record in presentation format.
+func hasRecord(rrs []dns.RR, record string) bool {
+	expected := strings.Fields(record)
+	for _, rr := range rrs {
+		fields := strings.Fields(rr.String())
+		if strings.Join(append([]string{fields[0]}, fields[3:]...), " ") == strings.Join(expected, " ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAccountDNAME(t *testing.T) {
+	n := indexedNEAR(t, map[string]string{
+		"alice:DNAME":           "@ 300 IN DNAME bob.near.",
+		"www.bob:contenthash":   testContentHash,
+		"www.bob:A":             "@ 300 IN A 192.0.2.1",
+		"carol:contenthash":     testContentHash,
+		"carol:A":               "@ 300 IN A 192.0.2.2",
+		"www.carol:contenthash": testContentHash,
+		"www.carol:A":           "@ 300 IN A 192.0.2.3",
+	})
+
+	// Accounts below alice.near are redirected by its DNAME
+	a := serve(t, n, "www.alice.near.", dns.TypeA, false)
+	for _, expected := range []string{
+		"alice.near. DNAME bob.near.",
+		"www.alice.near. CNAME www.bob.near.",
+		"www.bob.near. A 192.0.2.1",
+	} {
+		if !hasRecord(a.Answer, expected) {
+			t.Errorf("answer for www.alice.near. => %v (expected %s)", a.Answer, expected)
+		}
+	}
+
+	// The DNAME does not apply to its owner
+	a = serve(t, n, "alice.near.", dns.TypeA, false)
+	if len(a.Answer) != 0 {
+		t.Errorf("answer for alice.near. => %v (expected none)", a.Answer)
+	}
+
+	// Accounts below an account without a DNAME are not redirected
+	a = serve(t, n, "www.carol.near.", dns.TypeA, false)
+	if len(a.Answer) != 1 || !hasRecord(a.Answer, "www.carol.near. A 192.0.2.3") {
+		t.Errorf("answer for www.carol.near. => %v", a.Answer)
+	}
+}
+
+func TestSubdomainGatewayCNAME(t *testing.T) {
+	// A CIDv1 with a SHA-512 multihash is longer than a label in base32
+	longContentHash := "e30101701340" + strings.Repeat("ab", 64)
+	n := indexedNEAR(t, map[string]string{
+		"alice:contenthash": testContentHash,
+		"bob:contenthash":   longContentHash,
+	})
+	n.SubdomainGateway = "dweb.link."
+	n.IPFSGatewayAs = []string{"192.0.2.80"}
+
+	a := serve(t, n, "alice.near.", dns.TypeA, false)
+	if len(a.Answer) == 0 || a.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("answer for alice.near. => %v (expected a subdomain gateway CNAME)", a.Answer)
+	}
+
+	// Long CIDs fall back to the gateway addresses
+	a = serve(t, n, "bob.near.", dns.TypeA, false)
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 1 || !hasRecord(a.Answer, "bob.near. A 192.0.2.80") {
+		t.Errorf("answer for bob.near. => %s %v (expected the gateway address)", dns.RcodeToString[a.Rcode], a.Answer)
+	}
+}
+
+func TestChainLoops(t *testing.T) {
+	longTarget := strings.Repeat(strings.Repeat("a", 60)+".", 3) + "bob.near."
+	n := indexedNEAR(t, map[string]string{
+		"alice:CNAME": "@ 300 IN CNAME bob.near.",
+		"bob:CNAME":   "@ 300 IN CNAME alice.near.",
+		"carol:DNAME": "@ 300 IN DNAME a.carol.near.",
+		"dave:DNAME":  "@ 300 IN DNAME " + longTarget,
+	})
+
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{"alice.near.", dns.RcodeServerFailure},
+		{"www.carol.near.", dns.RcodeServerFailure},
+		{strings.Repeat("c", 60) + "." + strings.Repeat("d", 60) + ".dave.near.", dns.RcodeYXDomain},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := n.ServeDNS(context.TODO(), rec, r)
+		if err != nil || rcode != tt.rcode {
+			t.Errorf("query for %s => %s, %v (expected %s)", tt.name, dns.RcodeToString[rcode], err, dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestContractFailure(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer node.Close()
+	n := NEAR{
+		Next:                test.ErrorHandler(),
+		Client:              &nearclient.Client{URL: node.URL},
+		NEARDNS:             "dns.near",
+		NEARLinkNameServers: []string{"ns1.near.link."},
+	}
+
+	// Contract failures are not answered as names without records
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"alice.near.", dns.TypeMX},
+		{"_dmarc.alice.near.", dns.TypeTXT},
+		{"alice.near.", dns.TypeDS},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(q.name, q.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if rcode, _ := n.ServeDNS(context.TODO(), rec, r); rcode != dns.RcodeServerFailure {
+			t.Errorf("%s %s with a failing contract => %s (expected SERVFAIL)", q.name, dns.TypeToString[q.qtype], dns.RcodeToString[rcode])
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package near
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultZonePoll is how often the contract state is read for changes.
+	defaultZonePoll = 30 * time.Second
+	// defaultNotifyRetries is how often a NOTIFY is retried before giving up.
+	defaultNotifyRetries = 3
+	// defaultNotifyTimeout is how long to wait for a NOTIFY to be
+	// acknowledged.
+	defaultNotifyTimeout = 5 * time.Second
+)
+
+// Notifier sends DNS NOTIFY messages (RFC 1996) to secondary nameservers
+// when the zone changes.  Secondaries are given as host:port, where the host
+// can be a name that is resolved for every notification; only addresses in
+// the allowed networks are notified, if any are set.
+type Notifier struct {
+	Secondaries []string
+	Allow       []*net.IPNet
+	Retries     int
+	Timeout     time.Duration
+}
+
+// NewNotifier creates a notifier for the secondaries with the default retry
+// settings.
+func NewNotifier(secondaries []string) *Notifier {
+	return &Notifier{Secondaries: secondaries, Retries: defaultNotifyRetries, Timeout: defaultNotifyTimeout}
+}
+
+// Notify notifies every secondary that the zone has changed to the SOA and
+// waits for them to acknowledge or for their retries to run out.
+func (n *Notifier) Notify(zone string, soa *dns.SOA) {
+	var wg sync.WaitGroup
+	for _, secondary := range n.Secondaries {
+		addresses, err := n.addresses(secondary)
+		if err != nil {
+			log.Warnf("failed to notify %s of %s: %v", secondary, zone, err)
+			continue
+		}
+		for _, address := range addresses {
+			wg.Add(1)
+			go func(address string) {
+				defer wg.Done()
+				if err := n.notify(zone, soa, address); err != nil {
+					log.Warnf("failed to notify %s of %s serial %d: %v", address, zone, soa.Serial, err)
+				}
+			}(address)
+		}
+	}
+	wg.Wait()
+}
+
+// addresses resolves a secondary to the addresses to notify.
+func (n *Notifier) addresses(secondary string) ([]string, error) {
+	host, port, err := net.SplitHostPort(secondary)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0)
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), n.Timeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if !n.allowed(ip) {
+			log.Warnf("not notifying %s for %s; address is not allowed", ip, secondary)
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	return addresses, nil
+}
+
+// allowed returns true if the address may be notified.
+func (n *Notifier) allowed(ip net.IP) bool {
+	if len(n.Allow) == 0 {
+		return true
+	}
+	for _, network := range n.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// notify sends a NOTIFY to a single address until it is acknowledged.
+func (n *Notifier) notify(zone string, soa *dns.SOA, address string) error {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	m.Answer = []dns.RR{soa}
+	client := &dns.Client{Timeout: n.Timeout}
+
+	var err error
+	for attempt := 0; attempt <= n.Retries; attempt++ {
+		var r *dns.Msg
+		r, _, err = client.Exchange(m, address)
+		if err != nil {
+			continue
+		}
+		if r.Opcode != dns.OpcodeNotify || r.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("NOTIFY answered with %s", dns.RcodeToString[r.Rcode])
+			continue
+		}
+		log.Infof("notified %s of %s serial %d", address, zone, soa.Serial)
+		return nil
+	}
+	return err
+}
+
+// WatchZone starts reading the contract state for changes every poll
+// interval.  A change gives the zone a new serial, and the secondaries are
+// notified of it.
+func (n NEAR) WatchZone() error {
+	z := n.ZoneTransfer
+	z.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		n.pollZone()
+		ticker := time.NewTicker(z.Poll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				n.pollZone()
+			}
+		}
+	}(z.stop)
+	return nil
+}
+
+// pollZone reads the contract state and notifies the secondaries if the
+// zone has changed since it was last read.
+func (n NEAR) pollZone() {
+	z := n.ZoneTransfer
+	previous, _ := z.serial()
+	snapshot, err := n.currentZone(true)
+	if err != nil {
+		log.Warnf("failed to read zone %s: %v", n.zone(), err)
+		return
+	}
+	if snapshot.serial != previous && z.Notifier != nil {
+		z.Notifier.Notify(n.zone(), snapshot.soa)
+	}
+}
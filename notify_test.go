@@ -0,0 +1,138 @@
+package near
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// notifyServer is a secondary that records the NOTIFY messages it receives.
+// The next failures messages are answered with SERVFAIL.
+type notifyServer struct {
+	mu       sync.Mutex
+	serials  []uint32
+	failures int
+}
+
+func (s *notifyServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if s.failures > 0 {
+		s.failures--
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	if r.Opcode == dns.OpcodeNotify && len(r.Answer) == 1 {
+		s.serials = append(s.serials, r.Answer[0].(*dns.SOA).Serial)
+	}
+	w.WriteMsg(m)
+}
+
+// received returns the serials notified so far.
+func (s *notifyServer) received() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32{}, s.serials...)
+}
+
+// startNotifyServer starts a secondary on a local UDP port and returns its
+// address.
+func startNotifyServer(t *testing.T, handler dns.Handler) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestNotifierAllowed(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	tests := []struct {
+		allow   []*net.IPNet
+		ip      string
+		allowed bool
+	}{
+		{nil, "198.51.100.1", true},
+		{[]*net.IPNet{network}, "192.0.2.53", true},
+		{[]*net.IPNet{network}, "198.51.100.1", false},
+	}
+	for _, tt := range tests {
+		n := &Notifier{Allow: tt.allow}
+		if allowed := n.allowed(net.ParseIP(tt.ip)); allowed != tt.allowed {
+			t.Errorf("Failure: %v => %v (expected %v)\n", tt.ip, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	secondary := &notifyServer{failures: 2}
+	address, stop := startNotifyServer(t, secondary)
+	defer stop()
+
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "near.link.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Ns: "ns1.near.link.", Mbox: "hostmaster.near.link.", Serial: 42}
+	n := &Notifier{Secondaries: []string{address}, Retries: 1, Timeout: time.Second}
+	n.Notify("near.link.", soa)
+	if received := secondary.received(); len(received) != 0 {
+		t.Errorf("NOTIFY with too few retries received %v (expected none)", received)
+	}
+
+	secondary.failures = 2
+	n.Retries = 2
+	n.Notify("near.link.", soa)
+	if received := secondary.received(); len(received) != 1 || received[0] != 42 {
+		t.Errorf("NOTIFY received %v (expected [42])", received)
+	}
+
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	n.Allow = []*net.IPNet{network}
+	n.Notify("near.link.", soa)
+	if received := secondary.received(); len(received) != 1 {
+		t.Errorf("NOTIFY to an address that is not allowed received %v (expected [42] from before)", received)
+	}
+}
+
+func TestPollZone(t *testing.T) {
+	secondary := &notifyServer{}
+	address, stop := startNotifyServer(t, secondary)
+	defer stop()
+
+	height := 1000
+	value := "@ 300 IN A 192.0.2.1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"coredns-near","result":{"values":[{"key":"%s","value":"%s"}],"block_height":%d}}`,
+			base64.StdEncoding.EncodeToString([]byte("ralice:A")), base64.StdEncoding.EncodeToString([]byte(value)), height)
+	}))
+	defer server.Close()
+
+	n := NEAR{NEARDNS: "dns.near", NEARLinkNameServers: []string{"ns1.near.link."}, ZoneTransfer: NewZoneTransfer(server.URL, []byte("r"))}
+	n.ZoneTransfer.Notifier = &Notifier{Secondaries: []string{address}, Timeout: time.Second}
+
+	n.pollZone()
+	height = 1001
+	n.pollZone()
+	height = 1002
+	value = "@ 300 IN A 192.0.2.2"
+	n.pollZone()
+
+	received := secondary.received()
+	if len(received) != 2 || received[0] != 1000 || received[1] != 1002 {
+		t.Errorf("NOTIFY received %v (expected [1000 1002])", received)
+	}
+	if serial := n.serial(); serial != 1002 {
+		t.Errorf("SOA serial %d (expected 1002)", serial)
+	}
+}
@@ -0,0 +1,218 @@
+package near
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultRecordTypesMaxAge is how long the record types of an account
+	// are cached by default.
+	defaultRecordTypesMaxAge = time.Minute
+	// recordTypesCacheSize is the number of accounts whose record types are
+	// cached.
+	recordTypesCacheSize = 10000
+)
+
+// unknownTypes are the types listed in NSEC records for names whose record
+// types cannot be read from the contract, less the queried type.
+var unknownTypes = []uint16{
+	dns.TypeA, dns.TypeNS, dns.TypeCNAME, dns.TypeMX, dns.TypeTXT, dns.TypeAAAA, dns.TypeSRV,
+	dns.TypeNAPTR, dns.TypeDNAME, dns.TypeSSHFP, dns.TypeTLSA, dns.TypeSVCB, dns.TypeHTTPS, dns.TypeCAA,
+}
+
+// RecordTypesCache caches the record types that accounts store and whether
+// they have a content hash, including having neither, so that negative
+// answers and the type bitmaps of their NSEC records do not read the
+// contract on every query.
+type RecordTypesCache struct {
+	// MaxAge is how long the record types of an account are cached.
+	MaxAge time.Duration
+
+	cache *cache.Cache
+}
+
+// cachedTypes are the cached record types of an account.
+type cachedTypes struct {
+	types       []uint16
+	contentHash bool
+	fetched     time.Time
+}
+
+// NewRecordTypesCache creates a record types cache.
+func NewRecordTypesCache(maxAge time.Duration) *RecordTypesCache {
+	return &RecordTypesCache{MaxAge: maxAge, cache: cache.New(recordTypesCacheSize)}
+}
+
+// get returns the cached record types of an account and whether it has a
+// content hash, if they are cached and not older than MaxAge.
+func (c *RecordTypesCache) get(account string) ([]uint16, bool, bool) {
+	if c == nil {
+		return nil, false, false
+	}
+	cached, ok := c.cache.Get(cache.Hash([]byte(account)))
+	if !ok {
+		return nil, false, false
+	}
+	types := cached.(cachedTypes)
+	if time.Since(types.fetched) >= c.MaxAge {
+		return nil, false, false
+	}
+	return types.types, types.contentHash, true
+}
+
+// add caches the record types of an account and whether it has a content
+// hash.
+func (c *RecordTypesCache) add(account string, types []uint16, contentHash bool) {
+	if c == nil {
+		return
+	}
+	c.cache.Add(cache.Hash([]byte(account)), cachedTypes{types: types, contentHash: contentHash, fetched: time.Now()})
+}
+
+// accountTypes returns the record types that the account in domain stores
+// and whether it has a content hash, through the record types cache.
+func (n NEAR) accountTypes(domain string) ([]uint16, bool, error) {
+	if types, contentHash, cached := n.RecordTypes.get(domain); cached {
+		return types, contentHash, nil
+	}
+	contentHash, err := n.obtainContentHash(domain, domain)
+	if err != nil {
+		return nil, false, err
+	}
+	types, err := n.obtainRecordTypes(domain, domain)
+	if err != nil {
+		return nil, false, err
+	}
+	hasContentHash := bytes.Compare(contentHash, emptyContentHash) > 0
+	n.RecordTypes.add(domain, types, hasContentHash)
+	return types, hasContentHash, nil
+}
+
+// blackLie returns an NSEC record that denies the queried type at name
+// without revealing other names: its next name is the immediate successor
+// of the owner ("black lies").  Names that do not exist are answered as if
+// they had no records at all, so the type bitmap only lists NSEC and RRSIG.
+// qname is the owner in the served zone and name the internal name.
+func (n NEAR) blackLie(qname string, name string, qtype uint16, result Result, ttl uint32) *dns.NSEC {
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	if result == NoData {
+		for _, t := range n.nameTypes(name) {
+			if t != qtype {
+				types = append(types, t)
+			}
+		}
+	}
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: qname, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + qname,
+		TypeBitMap: sortTypes(types),
+	}
+}
+
+// nameTypes returns the record types that exist at an internal name: those
+// configured for the apex, or for accounts those the contract stores plus
+// those synthesized from the content hash.  Only the apex has an SOA, and
+// at a delegated account only the delegation is ours, so its types are NS
+// and DS.
+func (n NEAR) nameTypes(name string) []uint16 {
+	domain := highestAuthoritativeDomain(n, name)
+	if domain == zoneApex {
+		if name != zoneApex {
+			return nil
+		}
+		types := []uint16{dns.TypeSOA, dns.TypeNS}
+		if n.DNSSEC != nil {
+			types = append(types, dns.TypeDNSKEY)
+		}
+		if len(n.ApexAs) > 0 {
+			types = append(types, dns.TypeA)
+		}
+		if len(n.ApexAAAAs) > 0 {
+			types = append(types, dns.TypeAAAA)
+		}
+		if len(n.ApexTXTs) > 0 {
+			types = append(types, dns.TypeTXT)
+		}
+		return types
+	}
+	if name != domain || !validAccount(domain) {
+		// Record keys cannot be enumerated
+		return unknownTypes
+	}
+
+	nsRrs, dsRrs, err := n.Delegation(domain, name, true)
+	if err != nil {
+		return unknownTypes
+	}
+	if len(nsRrs) > 0 {
+		if nsRrs[0].Header().Name != name {
+			// Names below a zone cut are not ours
+			return nil
+		}
+		types := []uint16{dns.TypeNS}
+		if len(dsRrs) > 0 {
+			types = append(types, dns.TypeDS)
+		}
+		return types
+	}
+
+	stored, contentHash, err := n.accountTypes(domain)
+	if err != nil {
+		return unknownTypes
+	}
+	types := make([]uint16, 0, len(stored))
+	for _, t := range stored {
+		if t != dns.TypeSOA && t != dns.TypeDNSKEY {
+			types = append(types, t)
+		}
+	}
+	if contentHash {
+		types = append(types, dns.TypeNS, dns.TypeTXT, dns.TypeA, dns.TypeAAAA)
+		if n.HTTPS != nil {
+			types = append(types, dns.TypeHTTPS, dns.TypeSVCB)
+		}
+	}
+	return types
+}
+
+// sortTypes sorts types and removes duplicates, as NSEC type bitmaps
+// require.
+func sortTypes(types []uint16) []uint16 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	results := make([]uint16, 0, len(types))
+	for i, t := range types {
+		if i == 0 || t != types[i-1] {
+			results = append(results, t)
+		}
+	}
+	return results
+}
+
+// negativeOwner returns the name that a negative answer is about: the
+// question name, or the end of the CNAME chain in the answer.
+func negativeOwner(qname string, answer []dns.RR) string {
+	owner := qname
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, owner) {
+			owner = strings.ToLower(cname.Target)
+		}
+	}
+	return owner
+}
+
+// negativeTTL returns the TTL of negative answers: the TTL of the SOA in the
+// authority section, as capped by negativeSOA.
+func (n NEAR) negativeTTL(authority []dns.RR) uint32 {
+	for _, rr := range authority {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Ttl
+		}
+	}
+	return n.soaConfig().Minimum
+}
@@ -0,0 +1,146 @@
+package near
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeBlackLies(t *testing.T) {
+	key, _ := newTestKey(t, "near.link.", 257)
+	d, err := NewDNSSEC([]*SigningKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NEAR{Next: test.ErrorHandler(), NEARLinkNameServers: []string{"ns1.neardns.xyz."}, ApexAs: []string{"192.0.2.1"}, DNSSEC: d, Zone: "near.link."}
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		nsec  string
+	}{
+		{"near.link.", dns.TypeMX, `near.link. 300 IN NSEC \000.near.link. A NS SOA RRSIG NSEC DNSKEY`},
+		{"_dmarc.near.link.", dns.TypeTXT, `_dmarc.near.link. 300 IN NSEC \000._dmarc.near.link. RRSIG NSEC`},
+	}
+	for i, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		r.SetEdns0(4096, true)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := n.ServeDNS(context.TODO(), rec, r); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 0 {
+			t.Errorf("Test %d: expected NODATA, got %v", i, rec.Msg)
+			continue
+		}
+		var nsec *dns.NSEC
+		sigs := 0
+		for _, rr := range rec.Msg.Ns {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = rr
+			case *dns.RRSIG:
+				sigs++
+				if rr.TypeCovered == dns.TypeNSEC {
+					if err := rr.Verify(key.DNSKEY, []dns.RR{nsec}); err != nil {
+						t.Errorf("Test %d: NSEC signature does not verify: %v", i, err)
+					}
+				}
+			}
+		}
+		if nsec == nil || nsec.String() != newRR(tt.nsec).String() {
+			t.Errorf("Test %d: NSEC %v (expected %v)", i, nsec, tt.nsec)
+		}
+		if sigs != 2 {
+			t.Errorf("Test %d: expected signatures over SOA and NSEC, got %v", i, rec.Msg.Ns)
+		}
+	}
+}
+
+func TestAccountBlackLies(t *testing.T) {
+	key, _ := newTestKey(t, "near.link.", 257)
+	d, err := NewDNSSEC([]*SigningKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := indexedNEAR(t, map[string]string{
+		"bob:NS":            "@ 300 IN NS ns1.example.org.",
+		"bob:MX":            "@ 300 IN MX 10 mail.example.org.",
+		"carol:contenthash": testContentHash,
+		"carol:MX":          "@ 300 IN MX 10 mail.example.org.",
+		"carol:SOA":         "@ 300 IN SOA ns1.example.org. hostmaster.example.org. 1 2 3 4 5",
+	})
+	n.Zone = "near.link."
+	n.DNSSEC = d
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		nsec  string
+	}{
+		// The delegation of bob.near.link. is insecure, not the apex of a zone
+		{"bob.near.link.", dns.TypeDS, `bob.near.link. 300 IN NSEC \000.bob.near.link. NS RRSIG NSEC`},
+		// Accounts that are not delegated have no SOA
+		{"carol.near.link.", dns.TypeCAA, `carol.near.link. 300 IN NSEC \000.carol.near.link. A NS MX TXT AAAA RRSIG NSEC`},
+	}
+	for i, tt := range tests {
+		a := serve(t, n, tt.qname, tt.qtype, true)
+		var nsec *dns.NSEC
+		for _, rr := range a.Ns {
+			if rr, ok := rr.(*dns.NSEC); ok {
+				nsec = rr
+			}
+		}
+		if nsec == nil || nsec.String() != newRR(tt.nsec).String() {
+			t.Errorf("Test %d: NSEC %v (expected %v)", i, nsec, tt.nsec)
+		}
+	}
+}
+
+func TestRecordTypesCache(t *testing.T) {
+	n := indexedNEAR(t, map[string]string{
+		"carol:contenthash": testContentHash,
+		"dave:MX":           "@ 300 IN MX 10 mail.example.org.",
+	})
+	n.RecordTypes = NewRecordTypesCache(time.Hour)
+
+	tests := []struct {
+		domain  string
+		records bool
+	}{
+		{"alice.near.", false},
+		{"carol.near.", true},
+		{"dave.near.", true},
+	}
+	for i, tt := range tests {
+		if records, _ := n.HasRecords(tt.domain, tt.domain); records != tt.records {
+			t.Errorf("Test %d: %s => %v (expected %v)", i, tt.domain, records, tt.records)
+		}
+	}
+
+	// Record types are cached, including the absence of records
+	n.StateSync.mu.Lock()
+	delete(n.StateSync.accounts, "dave.near.")
+	index(n.StateSync.accounts, stateRecord{domain: "alice.near.", qtype: dns.TypeTXT, value: []byte("@ 300 IN TXT \"hello\"")})
+	n.StateSync.mu.Unlock()
+	for i, tt := range tests {
+		if records, _ := n.HasRecords(tt.domain, tt.domain); records != tt.records {
+			t.Errorf("Test %d: cached %s => %v (expected %v)", i, tt.domain, records, tt.records)
+		}
+	}
+	if types := n.nameTypes("dave.near."); len(types) != 1 || types[0] != dns.TypeMX {
+		t.Errorf("cached types of dave.near. => %v (expected MX)", types)
+	}
+	n.RecordTypes.MaxAge = 0
+	if records, _ := n.HasRecords("alice.near.", "alice.near."); !records {
+		t.Error("expired alice.near. => no records")
+	}
+	if records, _ := n.HasRecords("dave.near.", "dave.near."); records {
+		t.Error("expired dave.near. => records")
+	}
+}
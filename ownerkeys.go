@@ -0,0 +1,204 @@
+package near
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/miekg/dns"
+)
+
+// defaultOwnerKeysMaxAge is how long the access keys of an account are
+// cached by default.
+const defaultOwnerKeysMaxAge = 5 * time.Minute
+
+// ownerSignaturePrefix separates owner signatures over record sets from
+// other uses of the account keys.
+const ownerSignaturePrefix = "near-dns-rrset"
+
+// ownerSignedContentHash is the type mnemonic that content hashes are signed
+// with.
+const ownerSignedContentHash = "CONTENTHASH"
+
+// signedRRSet is a record set signed by its owner, as stored in the
+// contract: {"rrset": "<base64>", "signature": "ed25519:<base58>"}.  The
+// public key is optional and names the signing key.
+type signedRRSet struct {
+	RRSet     string `json:"rrset"`
+	Signature string `json:"signature"`
+	PublicKey string `json:"public_key"`
+}
+
+// OwnerKeys verifies that record sets are signed by one of the full-access
+// keys of their account, read from the NEAR node with view_access_key_list.
+// Record sets that fail are rejected if Reject is set, otherwise they are
+// served and counted.
+type OwnerKeys struct {
+	URL    string
+	Reject bool
+	// MaxAge is how long the keys of an account are cached.
+	MaxAge time.Duration
+	// BlockHeight, if set, observes the block height of key lists.
+	BlockHeight *BlockHeight
+
+	mu   sync.Mutex
+	keys map[string]ownerKeys
+}
+
+// ownerKeys are the cached full-access keys of an account.
+type ownerKeys struct {
+	keys    []ed25519.PublicKey
+	fetched time.Time
+}
+
+// NewOwnerKeys creates a verifier that reads keys from the NEAR node at url.
+func NewOwnerKeys(url string, reject bool, maxAge time.Duration) *OwnerKeys {
+	if maxAge <= 0 {
+		maxAge = defaultOwnerKeysMaxAge
+	}
+	return &OwnerKeys{URL: url, Reject: reject, MaxAge: maxAge, keys: make(map[string]ownerKeys)}
+}
+
+// Keys returns the full-access ed25519 keys of an account.
+func (o *OwnerKeys) Keys(account string) ([]ed25519.PublicKey, error) {
+	o.mu.Lock()
+	cached, exists := o.keys[account]
+	o.mu.Unlock()
+	if exists && time.Since(cached.fetched) < o.MaxAge {
+		return cached.keys, nil
+	}
+
+	keys, err := o.fetch(account)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	o.keys[account] = ownerKeys{keys: keys, fetched: time.Now()}
+	o.mu.Unlock()
+	return keys, nil
+}
+
+// fetch reads the full-access keys of an account from the NEAR node.
+func (o *OwnerKeys) fetch(account string) ([]ed25519.PublicKey, error) {
+	var result struct {
+		Keys []struct {
+			PublicKey string `json:"public_key"`
+			AccessKey struct {
+				Permission json.RawMessage `json:"permission"`
+			} `json:"access_key"`
+		} `json:"keys"`
+		BlockHeight uint64 `json:"block_height"`
+	}
+	params := map[string]string{
+		"request_type": "view_access_key_list",
+		"finality":     "final",
+		"account_id":   account,
+	}
+	if err := rpcCall(o.URL, "query", params, &result); err != nil {
+		return nil, err
+	}
+	if o.BlockHeight != nil {
+		o.BlockHeight.Observe(result.BlockHeight)
+	}
+
+	keys := make([]ed25519.PublicKey, 0, len(result.Keys))
+	for _, key := range result.Keys {
+		var permission string
+		if err := json.Unmarshal(key.AccessKey.Permission, &permission); err != nil || permission != "FullAccess" {
+			// Function call keys cannot sign records
+			continue
+		}
+		publicKey, err := decodeNEARKey(key.PublicKey, ed25519.PublicKeySize)
+		if err != nil {
+			// Other key types cannot sign records either
+			continue
+		}
+		keys = append(keys, ed25519.PublicKey(publicKey))
+	}
+	return keys, nil
+}
+
+// decodeNEARKey decodes an ed25519 key or signature in NEAR's
+// "ed25519:<base58>" format.
+func decodeNEARKey(value string, size int) ([]byte, error) {
+	if !strings.HasPrefix(value, "ed25519:") {
+		return nil, fmt.Errorf("not an ed25519 value: %q", value)
+	}
+	decoded, err := decodeBase58(strings.TrimPrefix(value, "ed25519:"))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != size {
+		return nil, fmt.Errorf("ed25519 value of %d bytes (expected %d)", len(decoded), size)
+	}
+	return decoded, nil
+}
+
+// ownerSignedMessage returns the message that the owner signs for a record
+// set: the prefix, account ID, record type mnemonic and record key, each
+// followed by a zero byte, and then the record set.  Content hashes, which
+// have no record type, are signed with the mnemonic CONTENTHASH.
+//
+// The message holds no sequence number or expiry, so a signed record set
+// that is replaced in the contract stays valid for as long as the key that
+// signed it is a full-access key of the account.  Only the contract, which
+// the owner alone can write to, serves record sets, so replaying one needs a
+// compromised node or contract; owners revoke old signatures by rotating
+// the signing key.
+func ownerSignedMessage(account string, qtype uint16, key string, rrSet []byte) []byte {
+	mnemonic := dns.TypeToString[qtype]
+	if qtype == dns.TypeNone {
+		mnemonic = ownerSignedContentHash
+	}
+	message := strings.Join([]string{ownerSignaturePrefix, account, mnemonic, key, ""}, "\x00")
+	return append([]byte(message), rrSet...)
+}
+
+// Verify checks the owner signature of a record set, or of a content hash if
+// qtype is TypeNone, read from the contract and returns the value it
+// carries.  In reject mode an error is
+// returned for record sets that are unsigned or fail verification; otherwise
+// they are logged and returned.
+func (o *OwnerKeys) Verify(account string, qtype uint16, key string, value []byte) ([]byte, error) {
+	var signed signedRRSet
+	if err := json.Unmarshal(value, &signed); err != nil || signed.RRSet == "" {
+		return o.fail(account, value, errors.New("record set is not signed"))
+	}
+	rrSet, err := base64.StdEncoding.DecodeString(signed.RRSet)
+	if err != nil {
+		return o.fail(account, value, fmt.Errorf("invalid signed record set: %v", err))
+	}
+	signature, err := decodeNEARKey(signed.Signature, ed25519.SignatureSize)
+	if err != nil {
+		return o.fail(account, rrSet, fmt.Errorf("invalid signature: %v", err))
+	}
+	keys, err := o.Keys(account)
+	if err != nil {
+		return o.fail(account, rrSet, fmt.Errorf("failed to read access keys: %v", err))
+	}
+
+	message := ownerSignedMessage(account, qtype, key, rrSet)
+	for _, publicKey := range keys {
+		if ed25519.Verify(publicKey, message, signature) {
+			return rrSet, nil
+		}
+	}
+	return o.fail(account, rrSet, errors.New("signature does not match a full-access key"))
+}
+
+// fail handles a record set that failed verification.
+func (o *OwnerKeys) fail(account string, rrSet []byte, err error) ([]byte, error) {
+	invalidRecordsCount.WithLabelValues(strings.TrimSuffix(account, ".near"), reasonSignature).Inc()
+	if o.Reject {
+		log.Warnf("rejecting record set of %s: %v", account, err)
+		return nil, err
+	}
+	log.Warnf("serving record set of %s that failed verification: %v", account, err)
+	return rrSet, nil
+}
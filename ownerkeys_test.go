@@ -0,0 +1,111 @@
+package near
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// encodeBase58 encodes data in base58, for NEAR keys and signatures.
+func encodeBase58(data []byte) string {
+	value := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	encoded := make([]byte, 0)
+	for value.Sign() > 0 {
+		value.DivMod(value, radix, mod)
+		encoded = append([]byte{base58Alphabet[mod.Int64()]}, encoded...)
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append([]byte{'1'}, encoded...)
+	}
+	return string(encoded)
+}
+
+func TestOwnerKeysVerify(t *testing.T) {
+	fullPub, fullPriv, _ := ed25519.GenerateKey(nil)
+	callPub, callPriv, _ := ed25519.GenerateKey(nil)
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"coredns-near","result":{"block_height":1234,"keys":[`+
+			`{"public_key":"ed25519:%s","access_key":{"nonce":1,"permission":"FullAccess"}},`+
+			`{"public_key":"ed25519:%s","access_key":{"nonce":1,"permission":{"FunctionCall":{"receiver_id":"dns.near","method_names":[]}}}}]}}`,
+			encodeBase58(fullPub), encodeBase58(callPub))
+	}))
+	defer server.Close()
+
+	rrSet := []byte("@ 300 IN A 192.0.2.1")
+	sign := func(priv ed25519.PrivateKey, qtype uint16, key string) []byte {
+		signature := ed25519.Sign(priv, ownerSignedMessage("alice.near", qtype, key, rrSet))
+		value, _ := json.Marshal(signedRRSet{
+			RRSet:     base64.StdEncoding.EncodeToString(rrSet),
+			Signature: "ed25519:" + encodeBase58(signature),
+		})
+		return value
+	}
+
+	tests := []struct {
+		reject bool
+		value  []byte
+		valid  bool
+	}{
+		{true, sign(fullPriv, dns.TypeA, ""), true},
+		{true, sign(callPriv, dns.TypeA, ""), false},
+		{true, sign(otherPriv, dns.TypeA, ""), false},
+		{true, sign(fullPriv, dns.TypeAAAA, ""), false},
+		{true, sign(fullPriv, dns.TypeA, "www"), false},
+		{true, rrSet, false},
+		{false, sign(otherPriv, dns.TypeA, ""), true},
+		{false, rrSet, true},
+	}
+	for i, tt := range tests {
+		o := NewOwnerKeys(server.URL, tt.reject, time.Hour)
+		o.BlockHeight = NewBlockHeight(server.URL, time.Hour)
+		result, err := o.Verify("alice.near", dns.TypeA, "", tt.value)
+		if tt.valid != (err == nil) {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if err == nil && string(result) != string(rrSet) {
+			t.Errorf("Test %d: returned %q (expected %q)", i, result, rrSet)
+		}
+	}
+
+	// Content hashes are signed as CONTENTHASH
+	o := NewOwnerKeys(server.URL, true, time.Hour)
+	if _, err := o.Verify("alice.near", dns.TypeNone, "", sign(fullPriv, dns.TypeNone, "")); err != nil {
+		t.Errorf("signed content hash failed verification: %v", err)
+	}
+	if _, err := o.Verify("alice.near", dns.TypeNone, "", sign(fullPriv, dns.TypeA, "")); err == nil {
+		t.Errorf("record set signature verified as a content hash")
+	}
+	if _, err := o.Verify("alice.near", dns.TypeNone, "", rrSet); err == nil {
+		t.Errorf("unsigned content hash verified")
+	}
+
+	// Keys are cached
+	o = NewOwnerKeys(server.URL, true, time.Hour)
+	requests = 0
+	for i := 0; i < 3; i++ {
+		if _, err := o.Keys("alice.near"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request for cached keys, got %d", requests)
+	}
+}
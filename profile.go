@@ -0,0 +1,340 @@
+package near
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	b64 "encoding/base64"
+
+	"github.com/labstack/gommon/log"
+	"github.com/miekg/dns"
+)
+
+// Record kinds read from the contract.
+const (
+	kindContentHash = "content_hash"
+	kindA           = "a"
+	kindAAAA        = "aaaa"
+	kindTXT         = "txt"
+	kindHTTPS       = "https"
+	kindDS          = "ds"
+	kindDNSKEY      = "dnskey"
+	kindRecords     = "records"
+	kindTypes       = "types"
+)
+
+// Formats of the account argument.
+const (
+	// accountShort passes the account without the .near suffix.
+	accountShort = "short"
+	// accountFull passes the full account ID, including the .near suffix.
+	accountFull = "full"
+)
+
+// Formats of the record type argument.
+const (
+	// typeNumber passes the record type as its number, for example 15.
+	typeNumber = "number"
+	// typeMnemonic passes the record type as its mnemonic, for example "MX".
+	typeMnemonic = "mnemonic"
+)
+
+// errUnsupportedKind is returned when the contract has no method for a
+// record kind.
+var errUnsupportedKind = errors.New("record kind not supported by contract")
+
+// ContractProfile describes the interface of a NEAR DNS contract deployment:
+// the view methods that serve each kind of record, how their arguments are
+// laid out and how their results are encoded.
+type ContractProfile struct {
+	Name string
+	// Methods maps record kinds to view method names.  Kinds without a
+	// method are read through the records method, if there is one.
+	Methods map[string]string
+	// AccountArg, TypeArg and KeyArg are the names of the arguments that
+	// carry the account, the record type and the record key.
+	AccountArg string
+	TypeArg    string
+	KeyArg     string
+	// AccountFormat is the format of the account argument.
+	AccountFormat string
+	// TypeFormat is the format of the record type argument.
+	TypeFormat string
+	// ResultEncoding is the encoding of view results, one of the
+	// registered result decoders.
+	ResultEncoding string
+	// ResultField is the member of a JSON object result that holds the
+	// payload, for encodings that use one.
+	ResultField string
+	// MetadataMethod is the view method that returns the contract
+	// metadata, used to detect the contract version.
+	MetadataMethod string
+
+	// overrides are the configured changes to the profile, reapplied when
+	// the profile is replaced after version detection.
+	overrides []func(*ContractProfile)
+}
+
+// contractProfiles are the built-in contract profiles.
+var contractProfiles = map[string]ContractProfile{
+	"neardns": {
+		Name: "neardns",
+		Methods: map[string]string{
+			kindContentHash: "get_content_hash",
+			kindA:           "get_a",
+			kindAAAA:        "get_aaaa",
+			kindTXT:         "get_txt",
+			kindHTTPS:       "get_https",
+			kindRecords:     "get_records",
+			kindTypes:       "get_record_types",
+		},
+		AccountArg:     "account_id",
+		TypeArg:        "record_type",
+		KeyArg:         "key",
+		AccountFormat:  accountShort,
+		TypeFormat:     typeNumber,
+		ResultEncoding: "json",
+		MetadataMethod: "get_metadata",
+	},
+	"neardns-records": {
+		Name: "neardns-records",
+		Methods: map[string]string{
+			kindContentHash: "get_content_hash",
+			kindRecords:     "get_records",
+			kindTypes:       "get_record_types",
+		},
+		AccountArg:     "account_id",
+		TypeArg:        "record_type",
+		KeyArg:         "key",
+		AccountFormat:  accountFull,
+		TypeFormat:     typeMnemonic,
+		ResultEncoding: "json",
+		MetadataMethod: "get_metadata",
+	},
+}
+
+// defaultContractProfile is the profile used if none is configured.
+const defaultContractProfile = "neardns"
+
+// contractVersions maps contract versions reported by the metadata method to
+// built-in profiles.
+var contractVersions = map[string]string{
+	"1": "neardns",
+	"2": "neardns-records",
+}
+
+// contractMetadata is the result of the metadata view method.
+type contractMetadata struct {
+	Version string `json:"version"`
+}
+
+// NewContractProfile returns a copy of a built-in contract profile.
+func NewContractProfile(name string) (*ContractProfile, error) {
+	base, exists := contractProfiles[strings.ToLower(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown contract profile %q", name)
+	}
+	profile := base
+	profile.Methods = make(map[string]string, len(base.Methods))
+	for kind, method := range base.Methods {
+		profile.Methods[kind] = method
+	}
+	return &profile, nil
+}
+
+// Override changes the profile and records the change so that it survives
+// version detection.
+func (p *ContractProfile) Override(override func(*ContractProfile)) {
+	override(p)
+	p.overrides = append(p.overrides, override)
+}
+
+// params returns the view call arguments to read a record kind of the
+// account in domain.  The record type and key are only passed to the records
+// method.
+func (p *ContractProfile) params(domain string, method string, qtype uint16, key string) ([]byte, error) {
+	account := strings.TrimSuffix(domain, ".")
+	if p.AccountFormat != accountFull {
+		account = strings.TrimSuffix(domain, ".near.")
+	}
+	params := map[string]interface{}{p.AccountArg: account}
+	if method == p.Methods[kindRecords] {
+		if p.TypeFormat == typeMnemonic {
+			params[p.TypeArg] = dns.TypeToString[qtype]
+		} else {
+			params[p.TypeArg] = qtype
+		}
+		if key != "" {
+			params[p.KeyArg] = key
+		}
+	}
+	return json.Marshal(params)
+}
+
+// method returns the view method for a record kind.  Kinds that the contract
+// does not serve directly are read through the records method.
+func (p *ContractProfile) method(kind string) (string, error) {
+	if method, exists := p.Methods[kind]; exists {
+		return method, nil
+	}
+	if kind != kindContentHash && kind != kindTypes {
+		if method, exists := p.Methods[kindRecords]; exists {
+			return method, nil
+		}
+	}
+	return "", errUnsupportedKind
+}
+
+// profile returns the contract profile, falling back to the default.
+func (n NEAR) profile() *ContractProfile {
+	if n.Profile != nil {
+		return n.Profile
+	}
+	profile, _ := NewContractProfile(defaultContractProfile)
+	return profile
+}
+
+// view reads a record kind for the account in domain from the contract and
+// decodes the result.  The local index is used instead while it is current.
+func (n NEAR) view(kind string, domain string, qtype uint16, key string) ([]byte, error) {
+	if n.StateSync != nil {
+		if value, ok := n.StateSync.Lookup(kind, domain, qtype, key); ok {
+			return value, nil
+		}
+	}
+	result, err := n.call(kind, domain, qtype, key)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := n.profile()
+	decoder, err := resultDecoder(profile.ResultEncoding)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := decoder.Decode(result, profile.ResultField)
+	if err != nil {
+		method, _ := profile.method(kind)
+		err = fmt.Errorf("failed to decode %s result of %s.%s for %s: %v", profile.ResultEncoding, n.NEARDNS, method, domain, err)
+		log.Warn(err)
+		invalidRecordsCount.WithLabelValues(strings.TrimSuffix(domain, ".near."), reasonEncoding).Inc()
+		return nil, err
+	}
+	if n.OwnerKeys != nil && len(dec) > 0 {
+		// Record sets and content hashes must be signed by the account owner
+		return n.OwnerKeys.Verify(strings.TrimSuffix(domain, "."), qtype, key, dec)
+	}
+
+	return dec, nil
+}
+
+// call calls the view method for a record kind of the account in domain and
+// returns the raw result.
+func (n NEAR) call(kind string, domain string, qtype uint16, key string) ([]byte, error) {
+	profile := n.profile()
+	method, err := profile.method(kind)
+	if err != nil {
+		return nil, err
+	}
+	params, err := profile.params(domain, method, qtype, key)
+	if err != nil {
+		return nil, err
+	}
+	paramsEnc := b64.StdEncoding.EncodeToString(params)
+
+	resp, err := n.Client.FunctionCall(n.NEARDNS, method, paramsEnc)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	var byte_result []byte
+
+	if err := json.Unmarshal(resp.Result, &byte_result); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return byte_result, nil
+}
+
+// parseRecordTypes parses the result of the record types method: a JSON list
+// of type numbers or mnemonics, or a JSON string holding such a list.
+func parseRecordTypes(result []byte) ([]uint16, error) {
+	var inner string
+	if err := json.Unmarshal(result, &inner); err == nil {
+		result = []byte(inner)
+	}
+	if len(bytes.TrimSpace(result)) == 0 || string(bytes.TrimSpace(result)) == "null" {
+		return []uint16{}, nil
+	}
+
+	var values []interface{}
+	if err := json.Unmarshal(result, &values); err != nil {
+		return nil, fmt.Errorf("record types are not a JSON list: %v", err)
+	}
+	types := make([]uint16, 0, len(values))
+	for _, value := range values {
+		switch value := value.(type) {
+		case float64:
+			if value < 1 || value > 65535 || value != float64(uint16(value)) {
+				return nil, fmt.Errorf("invalid record type %v", value)
+			}
+			types = append(types, uint16(value))
+		case string:
+			qtype, exists := dns.StringToType[strings.ToUpper(value)]
+			if !exists {
+				return nil, fmt.Errorf("unknown record type %q", value)
+			}
+			types = append(types, qtype)
+		default:
+			return nil, fmt.Errorf("invalid record type %v", value)
+		}
+	}
+	return types, nil
+}
+
+// DetectContractVersion reads the contract metadata and switches to the
+// built-in profile for the reported version.  The configured profile is kept
+// if the contract has no metadata or reports an unknown version.
+func (n NEAR) DetectContractVersion() error {
+	if n.Profile == nil || n.Profile.MetadataMethod == "" {
+		return nil
+	}
+	paramsEnc := b64.StdEncoding.EncodeToString([]byte("{}"))
+	resp, err := n.Client.FunctionCall(n.NEARDNS, n.Profile.MetadataMethod, paramsEnc)
+	if err != nil {
+		log.Warnf("failed to read contract metadata from %s: %v", n.NEARDNS, err)
+		return nil
+	}
+
+	var byte_result []byte
+	if err := json.Unmarshal(resp.Result, &byte_result); err != nil {
+		log.Warnf("failed to decode contract metadata from %s: %v", n.NEARDNS, err)
+		return nil
+	}
+	var metadata contractMetadata
+	if err := json.Unmarshal(byte_result, &metadata); err != nil {
+		log.Warnf("failed to decode contract metadata from %s: %v", n.NEARDNS, err)
+		return nil
+	}
+
+	name, exists := contractVersions[metadata.Version]
+	if !exists {
+		log.Warnf("unknown version %q of contract %s; using profile %s", metadata.Version, n.NEARDNS, n.Profile.Name)
+		return nil
+	}
+	profile, err := NewContractProfile(name)
+	if err != nil {
+		return err
+	}
+	log.Infof("contract %s is version %s; using profile %s", n.NEARDNS, metadata.Version, name)
+	for _, override := range n.Profile.overrides {
+		profile.Override(override)
+	}
+	*n.Profile = *profile
+	return nil
+}
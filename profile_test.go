@@ -0,0 +1,93 @@
+package near
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestContractProfile(t *testing.T) {
+	custom, _ := NewContractProfile("neardns")
+	custom.Override(func(p *ContractProfile) { p.Methods[kindA] = "a_records" })
+	custom.Override(func(p *ContractProfile) { p.AccountArg = "name" })
+
+	tests := []struct {
+		profile string
+		kind    string
+		qtype   uint16
+		key     string
+		method  string
+		params  string
+	}{
+		{"neardns", kindContentHash, dns.TypeNone, "", "get_content_hash", `{"account_id":"alice"}`},
+		{"neardns", kindA, dns.TypeA, "", "get_a", `{"account_id":"alice"}`},
+		{"neardns", kindRecords, dns.TypeMX, "", "get_records", `{"account_id":"alice","record_type":15}`},
+		{"neardns", kindRecords, dns.TypeSRV, "_sip._tcp", "get_records", `{"account_id":"alice","key":"_sip._tcp","record_type":33}`},
+		{"neardns-records", kindContentHash, dns.TypeNone, "", "get_content_hash", `{"account_id":"alice.near"}`},
+		{"neardns-records", kindA, dns.TypeA, "", "get_records", `{"account_id":"alice.near","record_type":"A"}`},
+		{"custom", kindA, dns.TypeA, "", "a_records", `{"name":"alice"}`},
+	}
+
+	for i, tt := range tests {
+		profile := custom
+		if tt.profile != "custom" {
+			var err error
+			profile, err = NewContractProfile(tt.profile)
+			if err != nil {
+				t.Fatalf("Test %d: %v", i, err)
+			}
+		}
+		method, err := profile.method(tt.kind)
+		if err != nil || method != tt.method {
+			t.Errorf("Test %d: method %s, %v (expected %s)", i, method, err, tt.method)
+			continue
+		}
+		params, err := profile.params("alice.near.", method, tt.qtype, tt.key)
+		if err != nil || string(params) != tt.params {
+			t.Errorf("Test %d: params %s, %v (expected %s)", i, params, err, tt.params)
+		}
+	}
+
+	// Built-in profiles are not changed by overrides
+	if profile, _ := NewContractProfile("neardns"); profile.Methods[kindA] != "get_a" || profile.AccountArg != "account_id" {
+		t.Errorf("Built-in profile modified: %v", profile)
+	}
+	if _, err := NewContractProfile("unknown"); err == nil {
+		t.Errorf("Expected error for unknown profile")
+	}
+}
+
+func TestParseRecordTypes(t *testing.T) {
+	tests := []struct {
+		result string
+		types  []uint16
+		err    bool
+	}{
+		{`[1, 15, 28]`, []uint16{dns.TypeA, dns.TypeMX, dns.TypeAAAA}, false},
+		{`["A", "mx"]`, []uint16{dns.TypeA, dns.TypeMX}, false},
+		{`"[16]"`, []uint16{dns.TypeTXT}, false},
+		{`[]`, []uint16{}, false},
+		{`null`, []uint16{}, false},
+		{`[70000]`, nil, true},
+		{`["BOGUS"]`, nil, true},
+		{`{"a": 1}`, nil, true},
+	}
+	for i, tt := range tests {
+		types, err := parseRecordTypes([]byte(tt.result))
+		if tt.err {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got %v", i, types)
+			}
+			continue
+		}
+		if err != nil || len(types) != len(tt.types) {
+			t.Errorf("Test %d: got %v, %v (expected %v)", i, types, err, tt.types)
+			continue
+		}
+		for j := range types {
+			if types[j] != tt.types[j] {
+				t.Errorf("Test %d: got %v (expected %v)", i, types, tt.types)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package near
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// handleRecords serves records of any type published by the account in the
+// contract.  Failures to read the contract are returned, so that they are not
+// mistaken for names without records.
+func (n NEAR) handleRecords(name string, domain string, qtype uint16) ([]dns.RR, error) {
+	rrSet, err := n.obtainRRSet(name, domain, qtype)
+	if err == errUnsupportedKind {
+		return make([]dns.RR, 0), nil
+	}
+	if err != nil || len(rrSet) == 0 {
+		return make([]dns.RR, 0), err
+	}
+
+	return n.contractRRSet(domain, rrSet, name, qtype), nil
+}
+
+// handleDS serves the DS records of the account, which link its own DNSSEC
+// keys into the chain of trust.  The DNSKEY records of the account belong to
+// its own zone, so they are never served here; if the account publishes
+// DNSKEY records but no DS records, the DS records are derived from its key
+// signing keys.
+func (n NEAR) handleDS(name string, domain string) ([]dns.RR, error) {
+	results := make([]dns.RR, 0)
+	rrSet, err := n.obtainDSRRSet(name, domain)
+	if err != nil && err != errUnsupportedKind {
+		return results, err
+	}
+	if len(rrSet) != 0 {
+		return n.contractRRSet(domain, rrSet, name, dns.TypeDS), nil
+	}
+
+	rrSet, err = n.obtainDNSKEYRRSet(name, domain)
+	if err != nil && err != errUnsupportedKind {
+		return results, err
+	}
+	if len(rrSet) == 0 {
+		return results, nil
+	}
+	ttl := n.synthesizedTTL(dns.TypeDS, false)
+	for _, rr := range n.contractRRSet(domain, rrSet, name, dns.TypeDNSKEY) {
+		dnskey := rr.(*dns.DNSKEY)
+		if dnskey.Flags&dns.SEP == 0 {
+			continue
+		}
+		if ds := dnskey.ToDS(dns.SHA256); ds != nil {
+			ds.Hdr.Ttl = ttl
+			results = append(results, ds)
+		}
+	}
+	return results, nil
+}
+
+// recordKey returns the record key of a name below the account domain, for
+// example "_matrix._tcp" for _matrix._tcp.alice.near.  It returns an empty
+// string for the account itself.
+func recordKey(name string, domain string) string {
+	if name == domain {
+		return ""
+	}
+	return strings.TrimSuffix(name, "."+domain)
+}
+
+// obtainRRSet reads the records of a given type for the account from the
+// contract.  Names below the account are read with their record key.
+func (n NEAR) obtainRRSet(name string, domain string, qtype uint16) ([]byte, error) {
+	return n.view(kindRecords, domain, qtype, recordKey(name, domain))
+}
@@ -0,0 +1,169 @@
+package near
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// rpcTimeout is the timeout of JSON-RPC calls to the NEAR node.
+const rpcTimeout = 10 * time.Second
+
+// blockHeightStartTimeout is how long startup waits for the block height.
+const blockHeightStartTimeout = 5 * time.Second
+
+var rpcHTTPClient = &http.Client{Timeout: rpcTimeout}
+
+// rpcRequest is a NEAR JSON-RPC request.
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      string      `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcResponse is a NEAR JSON-RPC response.
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	} `json:"error"`
+}
+
+// rpcCall makes a JSON-RPC call to the NEAR node at url and decodes the result
+// into result.
+func rpcCall(url string, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: "coredns-near", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	resp, err := rpcHTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP status %s", method, resp.Status)
+	}
+
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("%s: %s %s", method, rpcResp.Error.Message, rpcResp.Error.Data)
+	}
+	// Query errors are reported inside the result
+	var queryErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rpcResp.Result, &queryErr); err == nil && queryErr.Error != "" {
+		return fmt.Errorf("%s: %s", method, queryErr.Error)
+	}
+	return json.Unmarshal(rpcResp.Result, result)
+}
+
+// finalBlockHeight returns the height of the latest final block.
+func finalBlockHeight(url string) (uint64, error) {
+	var block struct {
+		Header struct {
+			Height uint64 `json:"height"`
+		} `json:"header"`
+	}
+	if err := rpcCall(url, "block", map[string]string{"finality": "final"}, &block); err != nil {
+		return 0, err
+	}
+	return block.Header.Height, nil
+}
+
+// BlockHeight caches the latest final block height of the NEAR chain.  The
+// height only ever increases, so it can be used as a zone serial.  It is
+// refreshed in the background, so reading it never waits on the NEAR node.
+type BlockHeight struct {
+	URL string
+	// MaxAge is how often the height is fetched.
+	MaxAge time.Duration
+
+	mu     sync.Mutex
+	height uint64
+	stop   chan struct{}
+}
+
+// NewBlockHeight creates a block height cache for the NEAR node at url.
+func NewBlockHeight(url string, maxAge time.Duration) *BlockHeight {
+	return &BlockHeight{URL: url, MaxAge: maxAge}
+}
+
+// Start fetches the block height, waiting up to blockHeightStartTimeout for
+// it, and then fetches it every MaxAge.
+func (b *BlockHeight) Start() error {
+	fetched := make(chan struct{})
+	go func() {
+		b.refresh()
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+	case <-time.After(blockHeightStartTimeout):
+		log.Warnf("NEAR block height not obtained within %s", blockHeightStartTimeout)
+	}
+
+	b.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(b.MaxAge)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				b.refresh()
+			}
+		}
+	}(b.stop)
+	return nil
+}
+
+// Stop stops fetching the block height.
+func (b *BlockHeight) Stop() error {
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	return nil
+}
+
+// refresh fetches the latest final block height.
+func (b *BlockHeight) refresh() {
+	height, err := finalBlockHeight(b.URL)
+	if err != nil {
+		log.Warnf("failed to obtain NEAR block height: %v", err)
+		return
+	}
+	b.Observe(height)
+}
+
+// Height returns the latest block height seen, or 0 if none has been seen
+// yet.
+func (b *BlockHeight) Height() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.height
+}
+
+// Observe records a block height seen elsewhere, such as in a view call
+// result.
+func (b *BlockHeight) Observe(height uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if height > b.height {
+		b.height = height
+	}
+}
@@ -0,0 +1,125 @@
+package near
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRecordTTL is the TTL of records stored in the contract without one.
+const defaultRecordTTL = 3600
+
+// Record formats that can be stored in the contract.
+const (
+	formatWire = iota
+	formatText
+	formatJSON
+)
+
+// jsonRecord is a record in the JSON record schema, for example
+// {"type": "A", "value": "192.0.2.1", "ttl": 300}.  The name is optional
+// and relative to the account; it defaults to the account itself.
+type jsonRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// recordFormat detects the format of a record set stored in the contract.
+// Wire format starts with a label length of at most 63, so cannot start
+// with '[' or '{', and its type and class fields always contain zero bytes,
+// which text never does.
+func recordFormat(rrSet []byte) int {
+	trimmed := bytes.TrimSpace(rrSet)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		return formatJSON
+	}
+	for _, b := range rrSet {
+		if (b < 0x20 && b != '\t' && b != '\n' && b != '\r') || b == 0x7f {
+			return formatWire
+		}
+	}
+	return formatText
+}
+
+// parseRRSet parses a record set stored in the contract in wire format,
+// zone file presentation format or the JSON record schema.  Relative names
+// in text and JSON records are relative to origin.  On error the records
+// parsed before the error are returned along with it.
+func parseRRSet(rrSet []byte, origin string) ([]dns.RR, error) {
+	switch recordFormat(rrSet) {
+	case formatJSON:
+		return parseJSONRRSet(rrSet, origin)
+	case formatText:
+		return parseTextRRSet(string(rrSet), origin)
+	default:
+		return parseWireRRSet(rrSet)
+	}
+}
+
+func parseWireRRSet(rrSet []byte) ([]dns.RR, error) {
+	results := make([]dns.RR, 0)
+	offset := 0
+	for offset < len(rrSet) {
+		result, next, err := dns.UnpackRR(rrSet, offset)
+		if err != nil {
+			return results, err
+		}
+		if result == nil || next <= offset {
+			return results, errors.New("invalid record")
+		}
+		offset = next
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func parseTextRRSet(rrSet string, origin string) ([]dns.RR, error) {
+	results := make([]dns.RR, 0)
+	zp := dns.NewZoneParser(strings.NewReader(rrSet), origin, "")
+	zp.SetDefaultTTL(defaultRecordTTL)
+	zp.SetIncludeAllowed(false)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		results = append(results, rr)
+	}
+	return results, zp.Err()
+}
+
+func parseJSONRRSet(rrSet []byte, origin string) ([]dns.RR, error) {
+	var records []jsonRecord
+	if err := json.Unmarshal(rrSet, &records); err != nil {
+		// Also accept an object holding the records
+		var wrapper struct {
+			Records []jsonRecord `json:"records"`
+		}
+		if err := json.Unmarshal(rrSet, &wrapper); err != nil {
+			return nil, err
+		}
+		records = wrapper.Records
+	}
+
+	var text strings.Builder
+	for _, record := range records {
+		if record.Type == "" || record.Value == "" {
+			return nil, errors.New("record without type or value")
+		}
+		if strings.ContainsAny(record.Name+record.Type+record.Value, "\r\n") {
+			return nil, errors.New("record with line break")
+		}
+		name := record.Name
+		if name == "" {
+			name = "@"
+		}
+		ttl := record.TTL
+		if ttl == 0 {
+			ttl = defaultRecordTTL
+		}
+		fmt.Fprintf(&text, "%s %d IN %s %s\n", name, ttl, strings.ToUpper(record.Type), record.Value)
+	}
+	return parseTextRRSet(text.String(), origin)
+}
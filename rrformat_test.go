@@ -0,0 +1,76 @@
+package near
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseRRSet(t *testing.T) {
+	tests := []struct {
+		rrSet   []byte
+		format  int
+		records []string
+		err     bool
+	}{
+		{
+			packRRs(t, "alice.near. 300 IN A 192.0.2.1", "alice.near. 300 IN A 192.0.2.2"),
+			formatWire,
+			[]string{"alice.near. 300 IN A 192.0.2.1", "alice.near. 300 IN A 192.0.2.2"},
+			false,
+		},
+		{
+			[]byte("@ 300 IN A 192.0.2.1\n@ IN TXT \"hello world\"\n"),
+			formatText,
+			[]string{"alice.near. 300 IN A 192.0.2.1", "alice.near. 300 IN TXT \"hello world\""},
+			false,
+		},
+		{
+			[]byte("$TTL 60\nalice.near. IN MX 10 mail\n"),
+			formatText,
+			[]string{"alice.near. 60 IN MX 10 mail.alice.near."},
+			false,
+		},
+		{
+			[]byte(`[{"type": "a", "value": "192.0.2.1", "ttl": 300}, {"type": "TXT", "value": "\"v=spf1 -all\""}]`),
+			formatJSON,
+			[]string{"alice.near. 300 IN A 192.0.2.1", "alice.near. 3600 IN TXT \"v=spf1 -all\""},
+			false,
+		},
+		{
+			[]byte(` {"records": [{"name": "_dmarc", "type": "TXT", "value": "\"v=DMARC1; p=none\""}]}`),
+			formatJSON,
+			[]string{"_dmarc.alice.near. 3600 IN TXT \"v=DMARC1; p=none\""},
+			false,
+		},
+		{[]byte(`[{"type": "A", "value": "192.0.2.1\n@ IN A 192.0.2.2"}]`), formatJSON, nil, true},
+		{[]byte(`[{"type": "A"}]`), formatJSON, nil, true},
+		{[]byte("@ IN A not-an-address"), formatText, nil, true},
+	}
+
+	for i, tt := range tests {
+		if format := recordFormat(tt.rrSet); format != tt.format {
+			t.Errorf("Test %d detected format %d (expected %d)", i, format, tt.format)
+		}
+		rrs, err := parseRRSet(tt.rrSet, "alice.near.")
+		if tt.err {
+			if err == nil {
+				t.Errorf("Test %d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if len(rrs) != len(tt.records) {
+			t.Errorf("Test %d returned %d records (expected %d)", i, len(rrs), len(tt.records))
+			continue
+		}
+		for j := range rrs {
+			if !dns.IsDuplicate(rrs[j], newRR(tt.records[j])) || rrs[j].Header().Ttl != newRR(tt.records[j]).Header().Ttl {
+				t.Errorf("Test %d: got %v (expected %v)", i, rrs[j], tt.records[j])
+			}
+		}
+	}
+}
@@ -22,8 +22,15 @@ const (
 	NoData
 	// ServerFailure indicates a server failure during the lookup.
 	ServerFailure
+	// NameTooLong indicates that a DNAME substitution produced a name that
+	// is too long (YXDOMAIN).
+	NameTooLong
 )
 
+// maxChainLength is the number of CNAME and DNAME records followed when
+// answering a query, which bounds chains and loops between records.
+const maxChainLength = 8
+
 // Server is an interface defined by any plugin that wishes to serve
 // authoritative records
 type Server interface {
@@ -39,6 +46,15 @@ type Server interface {
 	IsAuthoritative(qdomain string) bool
 }
 
+// Delegator is an interface defined by servers that delegate names to other
+// nameservers
+type Delegator interface {
+	// Delegation returns the NS records of the zone cut at or above qname
+	// that delegates it, along with the DS records at the cut.  It returns
+	// no records if qname is not delegated.
+	Delegation(domain string, qname string, do bool) ([]dns.RR, []dns.RR, error)
+}
+
 // Obtain the lowest domain for which we are authoritative
 func lowestAuthoritativeDomain(server Server, name string) string {
 	parts := strings.Split(name, ".")
@@ -74,6 +90,14 @@ func highestAuthoritativeDomain(server Server, name string) string {
 // Lookup contains the logic required to move through A DNS hierarchy and
 // gather the appropriate records
 func Lookup(server Server, state request.Request) ([]dns.RR, []dns.RR, []dns.RR, Result) {
+	return lookup(server, state, 0)
+}
+
+// lookup looks up a name reached through chain CNAME and DNAME records.
+func lookup(server Server, state request.Request, chain int) ([]dns.RR, []dns.RR, []dns.RR, Result) {
+	if chain > maxChainLength {
+		return nil, nil, nil, ServerFailure
+	}
 	qtype := state.QType()
 	do := state.Do()
 
@@ -93,82 +117,53 @@ func Lookup(server Server, state request.Request) ([]dns.RR, []dns.RR, []dns.RR,
 		return nil, nil, nil, NoData
 	}
 
-	// Look up parents of this name up to the domain to see if there are
-	// any DNAME records. If so we take the first matching
+	// Names at or below a zone cut are answered with a referral
+	if delegator, ok := server.(Delegator); ok {
+		nsRrs, dsRrs, err := delegator.Delegation(domain, name, do)
+		if err != nil {
+			return nil, nil, nil, ServerFailure
+		}
+		if len(nsRrs) > 0 {
+			return referral(server, domain, name, qtype, nsRrs, dsRrs, do)
+		}
+	}
+
+	// Look up the ancestors of this name to see if there are any DNAME
+	// records. If so we take the first matching.  Ancestors above the domain
+	// are looked up in their own domain while we are authoritative for them,
+	// as a domain can be nested in another (such as NEAR accounts)
 
-	dnameName := name
-	for {
-		if dnameName == domain {
-			break
+	for dnameName := parentName(name); dnameName != ""; dnameName = parentName(dnameName) {
+		dnameDomain := domain
+		if !dns.IsSubDomain(domain, dnameName) {
+			if !server.IsAuthoritative(dnameName) {
+				break
+			}
+			dnameDomain = dnameName
 		}
-		dnameRrs, err := server.Query(domain, dnameName, dns.TypeDNAME, do)
+		dnameRrs, err := server.Query(dnameDomain, dnameName, dns.TypeDNAME, do)
 		if err != nil {
 			return nil, nil, nil, ServerFailure
 		}
 		if len(dnameRrs) > 0 {
 			answerRrs = append(answerRrs, dnameRrs[0])
 			synthName := substituteDNAME(name, dnameRrs[0].Header().Name, dnameRrs[0].(*dns.DNAME).Target)
+			if _, ok := dns.IsDomainName(synthName); !ok {
+				// The substituted name does not fit (RFC 6672 section 2.2)
+				return answerRrs, authorityRrs, additionalRrs, NameTooLong
+			}
 			answerRrs = append(answerRrs, synthesizeCNAME(name, dnameRrs[0].(*dns.DNAME)))
 
 			// RECURSE
 			newReq := state.Req.Copy()
 			newReq.Question[0].Name = synthName
 			newState := request.Request{W: state.W, Req: newReq}
-			dnameAnswerRrs, dnameAuthorityRrs, dnameAdditionalRrs, dnameResult := Lookup(server, newState)
-			if dnameResult == Success {
-				answerRrs = append(answerRrs, dnameAnswerRrs...)
-				authorityRrs = append(authorityRrs, dnameAuthorityRrs...)
-				additionalRrs = append(additionalRrs, dnameAdditionalRrs...)
-			}
+			dnameAnswerRrs, dnameAuthorityRrs, dnameAdditionalRrs, dnameResult := lookup(server, newState, chain+1)
+			answerRrs = append(answerRrs, dnameAnswerRrs...)
+			authorityRrs = append(authorityRrs, dnameAuthorityRrs...)
+			additionalRrs = append(additionalRrs, dnameAdditionalRrs...)
 			return answerRrs, authorityRrs, additionalRrs, dnameResult
 		}
-		dotPos := strings.Index(dnameName, ".")
-		if dotPos == -1 {
-			break
-		}
-		if dotPos == len(dnameName) {
-			dnameName = "."
-		} else {
-			dnameName = dnameName[dotPos+1:]
-		}
-		if dnameName == "" {
-			break
-		}
-	}
-
-	// Wildcard substitution
-	if eligibleForWildcard(server, domain, name) {
-		// We don't have any records for this name so try again using '*' instead of the actual name
-		wildcardName := replaceWithAsteriskLabel(name)
-		if wildcardName != name {
-			newReq := state.Req.Copy()
-			newReq.Question[0].Name = wildcardName
-			newState := request.Request{W: state.W, Req: newReq}
-
-			wildcardAnswerRrs, wildcardAuthorityRrs, wildcardAdditionalRrs, wildcardResult := Lookup(server, newState)
-			if wildcardResult == Success {
-				// Replace the wildcard results with original query results
-				for _, answerRr := range wildcardAnswerRrs {
-					if answerRr.Header().Name == wildcardName {
-						answerRr.Header().Name = name
-					}
-					answerRrs = append(answerRrs, answerRr)
-				}
-				for _, authorityRr := range wildcardAuthorityRrs {
-					if authorityRr.Header().Name == wildcardName {
-						authorityRr.Header().Name = name
-					}
-					authorityRrs = append(authorityRrs, authorityRr)
-				}
-				for _, additionalRr := range wildcardAdditionalRrs {
-					if additionalRr.Header().Name == wildcardName {
-						additionalRr.Header().Name = name
-					}
-					additionalRrs = append(additionalRrs, additionalRr)
-				}
-			}
-			return answerRrs, authorityRrs, additionalRrs, wildcardResult
-		}
 	}
 
 	if qtype == dns.TypeNS {
@@ -178,7 +173,7 @@ func Lookup(server Server, state request.Request) ([]dns.RR, []dns.RR, []dns.RR,
 		}
 		// Nameserver records require additional processing
 		if domain != name || len(nsRrs) == 0 {
-			return nil, nil, nil, NoData
+			return nil, negativeSOA(server, domain, do), nil, NoData
 		}
 		// Add glue for the NS records if present
 		glueRrs := make([]dns.RR, 0)
@@ -207,18 +202,20 @@ func Lookup(server Server, state request.Request) ([]dns.RR, []dns.RR, []dns.RR,
 			// Found a CNAME; process it
 			answerRrs = append(answerRrs, cnameRrs[0])
 			cname := cnameRrs[0].(*dns.CNAME).Target
+			if highestAuthoritativeDomain(server, cname) == "." {
+				// Out of zone; the resolver chases the target itself
+				return answerRrs, authorityRrs, additionalRrs, Success
+			}
 			// Create a new request
 			newReq := state.Req.Copy()
 			newReq.Question[0].Name = cname
 			newReq.Question[0].Qtype = qtype
 			newState := request.Request{W: state.W, Req: newReq}
 			// Recurse with our new request
-			cnameAnswerRrs, cnameAuthorityRrs, cnameAdditionalrs, cnameResult := Lookup(server, newState)
-			if cnameResult == Success {
-				answerRrs = append(answerRrs, cnameAnswerRrs...)
-				authorityRrs = append(authorityRrs, cnameAuthorityRrs...)
-				additionalRrs = append(additionalRrs, cnameAdditionalrs...)
-			}
+			cnameAnswerRrs, cnameAuthorityRrs, cnameAdditionalrs, cnameResult := lookup(server, newState, chain+1)
+			answerRrs = append(answerRrs, cnameAnswerRrs...)
+			authorityRrs = append(authorityRrs, cnameAuthorityRrs...)
+			additionalRrs = append(additionalRrs, cnameAdditionalrs...)
 			return answerRrs, authorityRrs, additionalRrs, cnameResult
 		}
 	}
@@ -229,12 +226,131 @@ func Lookup(server Server, state request.Request) ([]dns.RR, []dns.RR, []dns.RR,
 		return nil, nil, nil, ServerFailure
 	}
 	if len(rrs) == 0 {
-		return nil, nil, nil, NoData
+		return negativeLookup(server, state, domain, name, chain)
 	}
 	answerRrs = append(answerRrs, rrs...)
-	if len(answerRrs) == 0 {
-		return answerRrs, authorityRrs, additionalRrs, NoData
-	}
 
 	return answerRrs, authorityRrs, additionalRrs, Success
 }
+
+// parentName returns the parent of a name, or an empty string for a top
+// level name.
+func parentName(name string) string {
+	dotIndex := strings.Index(name, ".")
+	if dotIndex < 0 || dotIndex == len(name)-1 {
+		return ""
+	}
+	return name[dotIndex+1:]
+}
+
+// referral answers a name at or below a zone cut.  The DS records at the cut
+// belong to the parent and are answered directly; anything else is referred
+// to the nameservers of the cut, with glue for those below it.
+func referral(server Server, domain string, name string, qtype uint16, nsRrs []dns.RR, dsRrs []dns.RR, do bool) ([]dns.RR, []dns.RR, []dns.RR, Result) {
+	cut := nsRrs[0].Header().Name
+	if qtype == dns.TypeDS && name == cut {
+		if len(dsRrs) == 0 {
+			return nil, negativeSOA(server, domain, do), nil, NoData
+		}
+		return dsRrs, nil, nil, Success
+	}
+
+	authorityRrs := make([]dns.RR, 0, len(nsRrs)+len(dsRrs))
+	authorityRrs = append(authorityRrs, nsRrs...)
+	if do {
+		authorityRrs = append(authorityRrs, dsRrs...)
+	}
+	additionalRrs := make([]dns.RR, 0)
+	for _, nsRr := range nsRrs {
+		ns, ok := nsRr.(*dns.NS)
+		if !ok || !dns.IsSubDomain(cut, ns.Ns) {
+			// Out of bailiwick; the resolver looks the nameserver up itself
+			continue
+		}
+		glueDomain := domain
+		if !dns.IsSubDomain(domain, ns.Ns) {
+			glueDomain = cut
+		}
+		glueARrs, err := server.Query(glueDomain, ns.Ns, dns.TypeA, do)
+		if err == nil {
+			additionalRrs = append(additionalRrs, glueARrs...)
+		}
+		glueAAAARrs, err := server.Query(glueDomain, ns.Ns, dns.TypeAAAA, do)
+		if err == nil {
+			additionalRrs = append(additionalRrs, glueAAAARrs...)
+		}
+	}
+	return nil, authorityRrs, additionalRrs, Delegation
+}
+
+// negativeLookup completes a lookup that found no records of the requested
+// type.  A name without any records is answered from a wildcard if there is
+// one, otherwise it does not exist.  Negative answers carry the SOA of the
+// domain so that resolvers can cache them (RFC 2308).
+func negativeLookup(server Server, state request.Request, domain string, name string, chain int) ([]dns.RR, []dns.RR, []dns.RR, Result) {
+	answerRrs := make([]dns.RR, 0)
+	authorityRrs := make([]dns.RR, 0)
+	additionalRrs := make([]dns.RR, 0)
+
+	// Wildcard substitution
+	if eligibleForWildcard(server, domain, name) {
+		// We don't have any records for this name so try again using '*' instead of the actual name
+		wildcardName := replaceWithAsteriskLabel(name)
+		if wildcardName != name {
+			newReq := state.Req.Copy()
+			newReq.Question[0].Name = wildcardName
+			newState := request.Request{W: state.W, Req: newReq}
+
+			wildcardAnswerRrs, wildcardAuthorityRrs, wildcardAdditionalRrs, wildcardResult := lookup(server, newState, chain)
+			// Replace the wildcard results with original query results
+			for _, answerRr := range wildcardAnswerRrs {
+				if answerRr.Header().Name == wildcardName {
+					answerRr.Header().Name = name
+				}
+				answerRrs = append(answerRrs, answerRr)
+			}
+			for _, authorityRr := range wildcardAuthorityRrs {
+				if authorityRr.Header().Name == wildcardName {
+					authorityRr.Header().Name = name
+				}
+				authorityRrs = append(authorityRrs, authorityRr)
+			}
+			for _, additionalRr := range wildcardAdditionalRrs {
+				if additionalRr.Header().Name == wildcardName {
+					additionalRr.Header().Name = name
+				}
+				additionalRrs = append(additionalRrs, additionalRr)
+			}
+			return answerRrs, authorityRrs, additionalRrs, wildcardResult
+		}
+		return nil, negativeSOA(server, domain, state.Do()), nil, NameError
+	}
+
+	return nil, negativeSOA(server, domain, state.Do()), nil, NoData
+}
+
+// negativeSOA returns the SOA of the zone holding the domain for the
+// authority section of a negative answer.  That is the SOA of the domain
+// itself or of its closest authoritative ancestor that has one.  Its TTL is
+// capped at the SOA minimum, which sets how long the answer can be cached.
+func negativeSOA(server Server, domain string, do bool) []dns.RR {
+	var soaRrs []dns.RR
+	for zone := domain; zone != "" && server.IsAuthoritative(zone); zone = parentName(zone) {
+		var err error
+		soaRrs, err = server.Query(zone, zone, dns.TypeSOA, do)
+		if err != nil {
+			return nil
+		}
+		if len(soaRrs) > 0 {
+			break
+		}
+	}
+	if len(soaRrs) == 0 {
+		return nil
+	}
+	soa := dns.Copy(soaRrs[0])
+	if s, ok := soa.(*dns.SOA); ok && s.Minttl < s.Hdr.Ttl {
+		s.Hdr.Ttl = s.Minttl
+	}
+	return []dns.RR{soa}
+}
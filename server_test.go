@@ -33,6 +33,7 @@ var server = MockServer{
 			{"example.com.", dns.ClassINET, dns.TypeNS, "example.com. 3600 IN NS ns1.example.com."},
 			{"example.com.", dns.ClassINET, dns.TypeNS, "example.com. 3600 IN NS ns2.example.com."},
 			{"www.example.com.", dns.ClassINET, dns.TypeCNAME, "www.example.com. 3600 IN CNAME example.com."},
+			{"ext.example.com.", dns.ClassINET, dns.TypeCNAME, "ext.example.com. 3600 IN CNAME www.example.org."},
 			{"ns1.example.com.", dns.ClassINET, dns.TypeA, "ns1.example.com. 3600 IN A 1.1.1.1"},
 			{"ns2.example.com.", dns.ClassINET, dns.TypeA, "ns2.example.com. 3600 IN A 1.1.1.2"},
 			{"example.com.", dns.ClassINET, dns.TypeA, "example.com. 3600 IN A 1.1.2.1"},
@@ -171,6 +172,12 @@ func TestLookup(t *testing.T) {
 			},
 			Ns: exampleComAuth,
 		},
+		{
+			Qname: "ext.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.CNAME("ext.example.com.    3600    IN  CNAME   www.example.org."),
+			},
+		},
 		{
 			Qname: "wildcard.example.com.", Qtype: dns.TypeA,
 			Answer: []dns.RR{
@@ -231,3 +238,53 @@ func TestAuthoritativeDomain(t *testing.T) {
 		}
 	}
 }
+
+func TestLookupNegative(t *testing.T) {
+	tests := []struct {
+		qname     string
+		qtype     uint16
+		result    Result
+		answers   int
+		authority []string
+	}{
+		{"example.com.", dns.TypeMX, NoData, 0, []string{"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2 19762 1800 1814400 14400"}},
+		{"wildcard.example.com.", dns.TypeA, Success, 1, nil},
+		{"wildcard.example.com.", dns.TypeMX, NoData, 0, []string{"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2 19762 1800 1814400 14400"}},
+		{"www.example.com.", dns.TypeMX, NoData, 1, []string{"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2 19762 1800 1814400 14400"}},
+		{"foo.example.net.", dns.TypeA, NameError, 0, nil},
+	}
+
+	for i, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.qname, tt.qtype)
+		state := request.Request{W: &test.ResponseWriter{}, Req: r}
+		answer, authority, _, result := Lookup(server, state)
+		if result != tt.result {
+			t.Errorf("Test %d: result %d (expected %d)", i, result, tt.result)
+		}
+		if len(answer) != tt.answers {
+			t.Errorf("Test %d: %d answers (expected %d)", i, len(answer), tt.answers)
+		}
+		if len(authority) != len(tt.authority) {
+			t.Errorf("Test %d: %d authority records (expected %d)", i, len(authority), len(tt.authority))
+			continue
+		}
+		for j := range authority {
+			if authority[j].String() != newRR(tt.authority[j]).String() {
+				t.Errorf("Test %d: authority %v (expected %v)", i, authority[j], tt.authority[j])
+			}
+		}
+	}
+}
+
+func TestNegativeSOATTL(t *testing.T) {
+	soaServer := MockServer{zones: []Zone{
+		{name: "example.org.", records: []Record{
+			{"example.org.", dns.ClassINET, dns.TypeSOA, "example.org. 3600 IN SOA ns1.example.org. hostmaster.example.org. 1 7200 900 1209600 300"},
+		}},
+	}}
+	soa := negativeSOA(soaServer, "example.org.", false)
+	if len(soa) != 1 || soa[0].Header().Ttl != 300 {
+		t.Errorf("Expected SOA with TTL 300, got %v", soa)
+	}
+}
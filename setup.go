@@ -1,49 +1,105 @@
 package near
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	nearclient "github.com/CrossChainLabs/near-api-go"
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
 )
 
+// blockHeightMaxAge is how often the block height used for serials is
+// fetched.
+const blockHeightMaxAge = 5 * time.Second
+
 // init registers this plugin.
 func init() { plugin.Register("near", setup) }
 
 // setup is the function that gets called when the config parser see the token "near". Setup is responsible
 // for parsing any extra options the near plugin may have.
 func setup(c *caddy.Controller) error {
-	connection, nearDns, nearLinkNameServers, ipfsGatewayAs, ipfsGatewayAAAAs, err := nearParse(c)
+	n, detectContractVersion, err := nearParse(c)
 
 	if err != nil {
 		return plugin.Error("near", err)
 	}
 
-	client := nearclient.Client{URL: connection}
+	if detectContractVersion {
+		c.OnStartup(n.DetectContractVersion)
+	}
+	if n.BlockHeight != nil {
+		c.OnStartup(n.BlockHeight.Start)
+		c.OnShutdown(n.BlockHeight.Stop)
+	}
+	if n.GatewayResolver != nil {
+		c.OnStartup(n.GatewayResolver.Start)
+		c.OnShutdown(n.GatewayResolver.Stop)
+	}
+	if n.KeyManager != nil {
+		c.OnStartup(n.KeyManager.Start)
+		c.OnShutdown(n.KeyManager.Stop)
+	}
+	if n.StateSync != nil {
+		c.OnStartup(n.StateSync.Start)
+		c.OnShutdown(n.StateSync.Stop)
+	}
+	if n.ZoneTransfer != nil {
+		c.OnStartup(n.WatchZone)
+		c.OnShutdown(n.ZoneTransfer.Stop)
+	}
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return NEAR{
-			Next:                next,
-			Client:              &client,
-			NEARDNS:             nearDns,
-			NEARLinkNameServers: nearLinkNameServers,
-			IPFSGatewayAs:       ipfsGatewayAs,
-			IPFSGatewayAAAAs:    ipfsGatewayAAAAs,
-		}
+		n.Next = next
+		return n
 	})
 
 	// All OK, return a nil error.
 	return nil
 }
 
-func nearParse(c *caddy.Controller) (string, string, []string, []string, []string, error) {
+func nearParse(c *caddy.Controller) (NEAR, bool, error) {
 	var connection string
 	var neardns string
 	nearLinkNameServers := make([]string, 0)
 	ipfsGatewayAs := make([]string, 0)
 	ipfsGatewayAAAAs := make([]string, 0)
+	var geoMap *GeoMap
+	gatewayPools := make(map[string]*GatewayPool)
+	poolNetworks := make(map[string]string)
+	ipfsGatewayNames := make([]string, 0)
+	var ipfsGatewayUpstream string
+	var ipfsGatewayRefresh time.Duration
+	ipfsGatewayCNAME := false
+	var ipfsSubdomainGateway string
+	var httpsConfig *HTTPSConfig
+	profileName := defaultContractProfile
+	profileOverrides := make([]func(*ContractProfile), 0)
+	var soaConfig *SOAConfig
+	var ttlPolicy *TTLPolicy
+	nameServerAddresses := make(map[string][]string)
+	var dnssecKeys []*SigningKey
+	zone := zoneApex
+	keyDir := ""
+	ownerSigned := ""
+	var ownerKeysMaxAge time.Duration
+	var transferPrefix []byte
+	zoneTransfer := false
+	transferPoll := defaultZonePoll
+	var stateSync *StateSync
+	var notifier *Notifier
+	keyAlgorithm := uint8(dns.ECDSAP256SHA256)
+	var zskLifetime, kskLifetime, keyPrepublish time.Duration
+	var keyParent string
+	var apexAs []string
+	var apexAAAAs []string
+	var apexTXTs []string
 
 	c.Next()
 	for c.NextBlock() {
@@ -51,53 +107,704 @@ func nearParse(c *caddy.Controller) (string, string, []string, []string, []strin
 		case "connection":
 			args := c.RemainingArgs()
 			if len(args) == 0 {
-				return "", "", nil, nil, nil, c.Errf("invalid connection; no value")
+				return NEAR{}, false, c.Errf("invalid connection; no value")
 			}
 			if len(args) > 1 {
-				return "", "", nil, nil, nil, c.Errf("invalid connection; multiple values")
+				return NEAR{}, false, c.Errf("invalid connection; multiple values")
 			}
 			connection = args[0]
 		case "neardns":
 			args := c.RemainingArgs()
 			if len(args) == 0 {
-				return "", "", nil, nil, nil, c.Errf("invalid neardns; no value")
+				return NEAR{}, false, c.Errf("invalid neardns; no value")
 			}
 			neardns = args[0]
 		case "nearlinknameservers":
 			args := c.RemainingArgs()
 			if len(args) == 0 {
-				return "", "", nil, nil, nil, c.Errf("invalid nearlinknameservers; no value")
+				return NEAR{}, false, c.Errf("invalid nearlinknameservers; no value")
 			}
 			nearLinkNameServers = make([]string, len(args))
-			copy(nearLinkNameServers, args)
+			for i, arg := range args {
+				// Nameservers can carry their addresses as name=ip,ip
+				kv := strings.SplitN(arg, "=", 2)
+				nearLinkNameServers[i] = kv[0]
+				if len(kv) == 1 {
+					continue
+				}
+				addresses := strings.Split(kv[1], ",")
+				for _, address := range addresses {
+					if net.ParseIP(address) == nil {
+						return NEAR{}, false, c.Errf("invalid nearlinknameservers address %q", address)
+					}
+				}
+				nameServerAddresses[dns.Fqdn(strings.ToLower(kv[0]))] = addresses
+			}
+		case "zone":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return NEAR{}, false, c.Errf("invalid zone; expected a single name")
+			}
+			zone = dns.Fqdn(strings.ToLower(args[0]))
+			if _, ok := dns.IsDomainName(zone); !ok {
+				return NEAR{}, false, c.Errf("invalid zone %q", args[0])
+			}
+		case "dnssec":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid DNSSEC; expected key files")
+			}
+			for _, arg := range args {
+				key, err := LoadSigningKey(arg)
+				if err != nil {
+					return NEAR{}, false, c.Errf("invalid DNSSEC key %q: %v", arg, err)
+				}
+				dnssecKeys = append(dnssecKeys, key)
+			}
+		case "dnsseckeys":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid DNSSEC keys; expected a directory")
+			}
+			keyDir = args[0]
+			for _, arg := range args[1:] {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 {
+					return NEAR{}, false, c.Errf("invalid DNSSEC keys parameter %q", arg)
+				}
+				switch strings.ToLower(kv[0]) {
+				case "algorithm":
+					algorithm, exists := dns.StringToAlgorithm[strings.ToUpper(kv[1])]
+					if !exists {
+						number, err := strconv.ParseUint(kv[1], 10, 8)
+						if err != nil {
+							return NEAR{}, false, c.Errf("invalid DNSSEC algorithm %q", kv[1])
+						}
+						algorithm = uint8(number)
+					}
+					keyAlgorithm = algorithm
+				case "parent":
+					keyParent = kv[1]
+					if _, _, err := net.SplitHostPort(keyParent); err != nil {
+						keyParent = net.JoinHostPort(keyParent, "53")
+					}
+				case "zsk", "ksk", "prepublish":
+					duration, err := time.ParseDuration(kv[1])
+					if err != nil || duration <= 0 {
+						return NEAR{}, false, c.Errf("invalid DNSSEC keys %s %q", kv[0], kv[1])
+					}
+					switch strings.ToLower(kv[0]) {
+					case "zsk":
+						zskLifetime = duration
+					case "ksk":
+						kskLifetime = duration
+					case "prepublish":
+						keyPrepublish = duration
+					}
+				default:
+					return NEAR{}, false, c.Errf("unknown DNSSEC keys parameter %q", kv[0])
+				}
+			}
+		case "ownersigned":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return NEAR{}, false, c.Errf("invalid owner signed; expected reject or flag and an optional key cache duration")
+			}
+			ownerSigned = strings.ToLower(args[0])
+			if ownerSigned != "reject" && ownerSigned != "flag" {
+				return NEAR{}, false, c.Errf("invalid owner signed mode %q", args[0])
+			}
+			if len(args) == 2 {
+				var err error
+				ownerKeysMaxAge, err = time.ParseDuration(args[1])
+				if err != nil || ownerKeysMaxAge <= 0 {
+					return NEAR{}, false, c.Errf("invalid owner signed key cache duration %q", args[1])
+				}
+			}
+		case "zonetransfer":
+			zoneTransfer = true
+			for _, arg := range c.RemainingArgs() {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 {
+					return NEAR{}, false, c.Errf("invalid zone transfer parameter %q", arg)
+				}
+				switch strings.ToLower(kv[0]) {
+				case "prefix", "prefix64":
+					prefix, err := parseStatePrefix(kv[0], kv[1])
+					if err != nil {
+						return NEAR{}, false, c.Errf("invalid zone transfer prefix %q", kv[1])
+					}
+					transferPrefix = prefix
+				case "poll":
+					poll, err := time.ParseDuration(kv[1])
+					if err != nil || poll <= 0 {
+						return NEAR{}, false, c.Errf("invalid zone transfer poll interval %q", kv[1])
+					}
+					transferPoll = poll
+				default:
+					return NEAR{}, false, c.Errf("unknown zone transfer parameter %q", kv[0])
+				}
+			}
+		case "statesync":
+			stateSync = NewStateSync("", "", nil)
+			for _, arg := range c.RemainingArgs() {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 {
+					return NEAR{}, false, c.Errf("invalid state sync parameter %q", arg)
+				}
+				switch strings.ToLower(kv[0]) {
+				case "prefix", "prefix64":
+					prefix, err := parseStatePrefix(kv[0], kv[1])
+					if err != nil {
+						return NEAR{}, false, c.Errf("invalid state sync prefix %q", kv[1])
+					}
+					stateSync.Prefix = prefix
+				case "poll":
+					poll, err := time.ParseDuration(kv[1])
+					if err != nil || poll <= 0 {
+						return NEAR{}, false, c.Errf("invalid state sync poll interval %q", kv[1])
+					}
+					stateSync.Poll = poll
+				case "lag":
+					lag, err := strconv.ParseUint(kv[1], 10, 64)
+					if err != nil {
+						return NEAR{}, false, c.Errf("invalid state sync lag %q", kv[1])
+					}
+					stateSync.MaxLag = lag
+				case "snapshot":
+					stateSync.Snapshot = kv[1]
+				case "checkpoint":
+					checkpoint, err := time.ParseDuration(kv[1])
+					if err != nil || checkpoint <= 0 {
+						return NEAR{}, false, c.Errf("invalid state sync checkpoint interval %q", kv[1])
+					}
+					stateSync.Checkpoint = checkpoint
+				case "snapshotage":
+					age, err := time.ParseDuration(kv[1])
+					if err != nil || age <= 0 {
+						return NEAR{}, false, c.Errf("invalid state sync snapshot age %q", kv[1])
+					}
+					stateSync.MaxSnapshotAge = age
+				default:
+					return NEAR{}, false, c.Errf("unknown state sync parameter %q", kv[0])
+				}
+			}
+		case "notify":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid notify; expected secondaries")
+			}
+			notifier = NewNotifier(nil)
+			for _, arg := range args {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) == 1 {
+					secondary := arg
+					if _, _, err := net.SplitHostPort(arg); err != nil {
+						secondary = net.JoinHostPort(arg, "53")
+					}
+					notifier.Secondaries = append(notifier.Secondaries, secondary)
+					continue
+				}
+				switch strings.ToLower(kv[0]) {
+				case "retries":
+					retries, err := strconv.Atoi(kv[1])
+					if err != nil || retries < 0 {
+						return NEAR{}, false, c.Errf("invalid notify retries %q", kv[1])
+					}
+					notifier.Retries = retries
+				case "timeout":
+					timeout, err := time.ParseDuration(kv[1])
+					if err != nil || timeout <= 0 {
+						return NEAR{}, false, c.Errf("invalid notify timeout %q", kv[1])
+					}
+					notifier.Timeout = timeout
+				case "allow":
+					for _, cidr := range strings.Split(kv[1], ",") {
+						_, network, err := net.ParseCIDR(cidr)
+						if err != nil {
+							return NEAR{}, false, c.Errf("invalid notify allow network %q", cidr)
+						}
+						notifier.Allow = append(notifier.Allow, network)
+					}
+				default:
+					return NEAR{}, false, c.Errf("unknown notify parameter %q", kv[0])
+				}
+			}
+			if len(notifier.Secondaries) == 0 {
+				return NEAR{}, false, c.Errf("invalid notify; expected secondaries")
+			}
+		case "apexa":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid apex A; no value")
+			}
+			for _, arg := range args {
+				if ip := net.ParseIP(arg); ip == nil || ip.To4() == nil {
+					return NEAR{}, false, c.Errf("invalid apex A %q", arg)
+				}
+			}
+			apexAs = append(apexAs, args...)
+		case "apexaaaa":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid apex AAAA; no value")
+			}
+			for _, arg := range args {
+				if ip := net.ParseIP(arg); ip == nil || ip.To4() != nil {
+					return NEAR{}, false, c.Errf("invalid apex AAAA %q", arg)
+				}
+			}
+			apexAAAAs = append(apexAAAAs, args...)
+		case "apextxt":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid apex TXT; no value")
+			}
+			for _, arg := range args {
+				if len(arg) > 255 {
+					return NEAR{}, false, c.Errf("invalid apex TXT; %q is longer than 255 characters", arg)
+				}
+			}
+			apexTXTs = append(apexTXTs, args...)
 		case "ipfsgatewaya":
 			args := c.RemainingArgs()
 			if len(args) == 0 {
-				return "", "", nil, nil, nil, c.Errf("invalid IPFS gateway A; no value")
+				return NEAR{}, false, c.Errf("invalid IPFS gateway A; no value")
 			}
 			ipfsGatewayAs = make([]string, len(args))
 			copy(ipfsGatewayAs, args)
 		case "ipfsgatewayaaaa":
 			args := c.RemainingArgs()
 			if len(args) == 0 {
-				return "", "", nil, nil, nil, c.Errf("invalid IPFS gateway AAAA; no value")
+				return NEAR{}, false, c.Errf("invalid IPFS gateway AAAA; no value")
 			}
 			ipfsGatewayAAAAs = make([]string, len(args))
 			copy(ipfsGatewayAAAAs, args)
+		case "geomap":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return NEAR{}, false, c.Errf("invalid geomap; expected a single file")
+			}
+			var err error
+			geoMap, err = loadGeoMap(args[0])
+			if err != nil {
+				return NEAR{}, false, c.Errf("invalid geomap: %v", err)
+			}
+		case "ipfsgatewaypool":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return NEAR{}, false, c.Errf("invalid IPFS gateway pool; expected region or CIDR and addresses")
+			}
+			tag := strings.ToLower(args[0])
+			if _, _, err := net.ParseCIDR(tag); err == nil {
+				poolNetworks[tag] = tag
+			}
+			pool, exists := gatewayPools[tag]
+			if !exists {
+				pool = &GatewayPool{}
+				gatewayPools[tag] = pool
+			}
+			for _, arg := range args[1:] {
+				ip := net.ParseIP(arg)
+				switch {
+				case ip == nil:
+					return NEAR{}, false, c.Errf("invalid IPFS gateway pool address %q", arg)
+				case ip.To4() != nil:
+					pool.As = append(pool.As, arg)
+				default:
+					pool.AAAAs = append(pool.AAAAs, arg)
+				}
+			}
+		case "ipfsgateway":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid IPFS gateway; no value")
+			}
+			ipfsGatewayNames = make([]string, len(args))
+			copy(ipfsGatewayNames, args)
+		case "ipfsgatewayupstream":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return NEAR{}, false, c.Errf("invalid IPFS gateway upstream; expected a single address")
+			}
+			ipfsGatewayUpstream = args[0]
+		case "ipfsgatewayrefresh":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return NEAR{}, false, c.Errf("invalid IPFS gateway refresh; expected a single duration")
+			}
+			var err error
+			ipfsGatewayRefresh, err = time.ParseDuration(args[0])
+			if err != nil || ipfsGatewayRefresh <= 0 {
+				return NEAR{}, false, c.Errf("invalid IPFS gateway refresh %q", args[0])
+			}
+		case "ipfsgatewaycname":
+			if len(c.RemainingArgs()) != 0 {
+				return NEAR{}, false, c.Errf("invalid IPFS gateway CNAME; unexpected value")
+			}
+			ipfsGatewayCNAME = true
+		case "ipfssubdomaingateway":
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return NEAR{}, false, c.Errf("invalid IPFS subdomain gateway; multiple values")
+			}
+			ipfsSubdomainGateway = "dweb.link."
+			if len(args) == 1 {
+				ipfsSubdomainGateway = dns.Fqdn(strings.ToLower(args[0]))
+			}
+		case "ipfsgatewayhttps":
+			httpsConfig = &HTTPSConfig{Alpn: defaultHTTPSAlpn}
+			for _, arg := range c.RemainingArgs() {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 || kv[1] == "" {
+					return NEAR{}, false, c.Errf("invalid IPFS gateway HTTPS parameter %q", arg)
+				}
+				switch strings.ToLower(kv[0]) {
+				case "alpn":
+					httpsConfig.Alpn = strings.Split(kv[1], ",")
+				case "port":
+					port, err := strconv.ParseUint(kv[1], 10, 16)
+					if err != nil {
+						return NEAR{}, false, c.Errf("invalid IPFS gateway HTTPS port %q", kv[1])
+					}
+					httpsConfig.Port = uint16(port)
+				default:
+					return NEAR{}, false, c.Errf("unknown IPFS gateway HTTPS parameter %q", kv[0])
+				}
+			}
+		case "soa":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid SOA; no value")
+			}
+			soaConfig = &SOAConfig{}
+			for _, arg := range args {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 || kv[1] == "" {
+					return NEAR{}, false, c.Errf("invalid SOA parameter %q", arg)
+				}
+				key := strings.ToLower(kv[0])
+				switch key {
+				case "mname":
+					soaConfig.MName = dns.Fqdn(strings.ToLower(kv[1]))
+				case "rname":
+					soaConfig.RName = dns.Fqdn(strings.ToLower(strings.Replace(kv[1], "@", ".", 1)))
+				case "ttl", "refresh", "retry", "expire", "minimum":
+					duration, err := parseTTL(kv[1])
+					if err != nil {
+						return NEAR{}, false, c.Errf("invalid SOA %s %q", key, kv[1])
+					}
+					switch key {
+					case "ttl":
+						soaConfig.TTL = duration
+					case "refresh":
+						soaConfig.Refresh = duration
+					case "retry":
+						soaConfig.Retry = duration
+					case "expire":
+						soaConfig.Expire = duration
+					case "minimum":
+						soaConfig.Minimum = duration
+					}
+				default:
+					return NEAR{}, false, c.Errf("unknown SOA parameter %q", kv[0])
+				}
+			}
+		case "ttl":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid TTL; no value")
+			}
+			if ttlPolicy == nil {
+				ttlPolicy = &TTLPolicy{Types: make(map[uint16]TTLBounds)}
+			}
+			scope := ""
+			if !strings.Contains(args[0], "=") {
+				scope = strings.ToUpper(args[0])
+				args = args[1:]
+			}
+			var bounds TTLBounds
+			for _, arg := range args {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 {
+					return NEAR{}, false, c.Errf("invalid TTL parameter %q", arg)
+				}
+				ttl, err := parseTTL(kv[1])
+				if err != nil {
+					return NEAR{}, false, c.Errf("invalid TTL %s %q", kv[0], kv[1])
+				}
+				switch strings.ToLower(kv[0]) {
+				case "default":
+					bounds.Default = ttl
+				case "min":
+					bounds.Min = ttl
+				case "max":
+					bounds.Max = ttl
+				default:
+					return NEAR{}, false, c.Errf("unknown TTL parameter %q", kv[0])
+				}
+			}
+			if bounds.Min != 0 && bounds.Max != 0 && bounds.Min > bounds.Max {
+				return NEAR{}, false, c.Errf("invalid TTL; min %d exceeds max %d", bounds.Min, bounds.Max)
+			}
+			switch scope {
+			case "":
+				ttlPolicy.All = bounds
+			case "GATEWAY":
+				ttlPolicy.Gateway = bounds
+			default:
+				qtype, exists := dns.StringToType[scope]
+				if !exists {
+					return NEAR{}, false, c.Errf("invalid TTL record type %q", scope)
+				}
+				ttlPolicy.Types[qtype] = bounds
+			}
+		case "contractprofile":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return NEAR{}, false, c.Errf("invalid contract profile; expected a single value")
+			}
+			profileName = strings.ToLower(args[0])
+			if _, exists := contractProfiles[profileName]; !exists && profileName != "auto" {
+				return NEAR{}, false, c.Errf("unknown contract profile %q", args[0])
+			}
+		case "contractmethod":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return NEAR{}, false, c.Errf("invalid contract method; expected record kind and method")
+			}
+			kind := strings.ToLower(args[0])
+			switch kind {
+			case kindContentHash, kindA, kindAAAA, kindTXT, kindHTTPS, kindDS, kindDNSKEY, kindRecords, kindTypes:
+			default:
+				return NEAR{}, false, c.Errf("unknown record kind %q", args[0])
+			}
+			method := args[1]
+			profileOverrides = append(profileOverrides, func(p *ContractProfile) {
+				if method == "-" {
+					delete(p.Methods, kind)
+				} else {
+					p.Methods[kind] = method
+				}
+			})
+		case "contractargs":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return NEAR{}, false, c.Errf("invalid contract arguments; no value")
+			}
+			for _, arg := range args {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 || kv[1] == "" {
+					return NEAR{}, false, c.Errf("invalid contract argument %q", arg)
+				}
+				field := kv[1]
+				switch strings.ToLower(kv[0]) {
+				case "account":
+					profileOverrides = append(profileOverrides, func(p *ContractProfile) { p.AccountArg = field })
+				case "type":
+					profileOverrides = append(profileOverrides, func(p *ContractProfile) { p.TypeArg = field })
+				case "key":
+					profileOverrides = append(profileOverrides, func(p *ContractProfile) { p.KeyArg = field })
+				default:
+					return NEAR{}, false, c.Errf("unknown contract argument %q", kv[0])
+				}
+			}
+		case "contractaccount":
+			args := c.RemainingArgs()
+			if len(args) != 1 || (args[0] != accountShort && args[0] != accountFull) {
+				return NEAR{}, false, c.Errf("invalid contract account format; expected %s or %s", accountShort, accountFull)
+			}
+			format := args[0]
+			profileOverrides = append(profileOverrides, func(p *ContractProfile) { p.AccountFormat = format })
+		case "contracttype":
+			args := c.RemainingArgs()
+			if len(args) != 1 || (args[0] != typeNumber && args[0] != typeMnemonic) {
+				return NEAR{}, false, c.Errf("invalid contract type format; expected %s or %s", typeNumber, typeMnemonic)
+			}
+			format := args[0]
+			profileOverrides = append(profileOverrides, func(p *ContractProfile) { p.TypeFormat = format })
+		case "contractresult":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return NEAR{}, false, c.Errf("invalid contract result; expected encoding and optional field")
+			}
+			if _, err := resultDecoder(args[0]); err != nil {
+				return NEAR{}, false, c.Errf("invalid contract result: %v", err)
+			}
+			encoding := strings.ToLower(args[0])
+			field := ""
+			if len(args) == 2 {
+				field = args[1]
+			}
+			profileOverrides = append(profileOverrides, func(p *ContractProfile) {
+				p.ResultEncoding = encoding
+				p.ResultField = field
+			})
+		case "contractmetadata":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return NEAR{}, false, c.Errf("invalid contract metadata; expected a single method")
+			}
+			method := args[0]
+			profileOverrides = append(profileOverrides, func(p *ContractProfile) { p.MetadataMethod = method })
 		default:
-			return "", "", nil, nil, nil, c.Errf("unknown value %v", c.Val())
+			return NEAR{}, false, c.Errf("unknown value %v", c.Val())
 		}
 	}
 	if connection == "" {
-		return "", "", nil, nil, nil, c.Errf("no connection")
+		return NEAR{}, false, c.Errf("no connection")
 	}
 	if len(nearLinkNameServers) == 0 {
-		return "", "", nil, nil, nil, c.Errf("no nearlinknameservers")
+		return NEAR{}, false, c.Errf("no nearlinknameservers")
 	}
 	for i := range nearLinkNameServers {
 		if !strings.HasSuffix(nearLinkNameServers[i], ".") {
 			nearLinkNameServers[i] = nearLinkNameServers[i] + "."
 		}
 	}
-	return connection, neardns, nearLinkNameServers, ipfsGatewayAs, ipfsGatewayAAAAs, nil
+	for region := range gatewayPools {
+		if _, isNetwork := poolNetworks[region]; !isNetwork && geoMap == nil {
+			return NEAR{}, false, c.Errf("IPFS gateway pool %s requires a geomap", region)
+		}
+	}
+	if len(poolNetworks) > 0 && geoMap == nil {
+		geoMap = NewGeoMap()
+	}
+	for cidr, region := range poolNetworks {
+		// Pools tagged with a CIDR are their own region
+		if err := geoMap.Add(cidr, region); err != nil {
+			return NEAR{}, false, c.Errf("invalid IPFS gateway pool: %v", err)
+		}
+	}
+	var gatewayResolver *GatewayResolver
+	if len(ipfsGatewayNames) > 0 {
+		var err error
+		gatewayResolver, err = NewGatewayResolver(ipfsGatewayNames, ipfsGatewayUpstream, ipfsGatewayRefresh)
+		if err != nil {
+			return NEAR{}, false, c.Errf("invalid IPFS gateway: %v", err)
+		}
+	}
+	if ipfsGatewayCNAME && gatewayResolver == nil {
+		return NEAR{}, false, c.Errf("ipfsgatewaycname requires ipfsgateway")
+	}
+	detectContractVersion := profileName == "auto"
+	if detectContractVersion {
+		profileName = defaultContractProfile
+	}
+	profile, err := NewContractProfile(profileName)
+	if err != nil {
+		return NEAR{}, false, c.Errf("invalid contract profile: %v", err)
+	}
+	for _, override := range profileOverrides {
+		profile.Override(override)
+	}
+
+	var dnssec *DNSSEC
+	var keyManager *KeyManager
+	if (keyDir != "" || len(dnssecKeys) > 0) && zone == zoneApex {
+		// Signatures cover owner names, so they must be those clients see
+		return NEAR{}, false, c.Errf("invalid DNSSEC; zone must be set to the served zone")
+	}
+	if zoneTransfer && (keyDir != "" || len(dnssecKeys) > 0) {
+		return NEAR{}, false, c.Errf("invalid zonetransfer; the transferred zone is not signed, so it cannot be combined with dnssec or dnsseckeys")
+	}
+	if keyDir != "" {
+		if len(dnssecKeys) > 0 {
+			return NEAR{}, false, c.Errf("invalid DNSSEC; dnssec and dnsseckeys are exclusive")
+		}
+		var err error
+		keyManager, err = NewKeyManager(keyDir, zone, keyAlgorithm, zskLifetime, kskLifetime, keyPrepublish)
+		if err != nil {
+			return NEAR{}, false, c.Errf("invalid DNSSEC keys: %v", err)
+		}
+		keyManager.Parent = keyParent
+		// The keys are rolled at startup; until then those in the
+		// directory are used
+		dnssec = newDNSSEC(keyManager.keySet(time.Now()))
+		keyManager.DNSSEC = dnssec
+	}
+	if len(dnssecKeys) > 0 {
+		for _, key := range dnssecKeys {
+			if !strings.EqualFold(key.DNSKEY.Hdr.Name, zone) {
+				return NEAR{}, false, c.Errf("invalid DNSSEC key for %s; expected a key for %s", key.DNSKEY.Hdr.Name, zone)
+			}
+		}
+		var err error
+		dnssec, err = NewDNSSEC(dnssecKeys)
+		if err != nil {
+			return NEAR{}, false, c.Errf("invalid DNSSEC: %v", err)
+		}
+	}
+
+	blockHeight := NewBlockHeight(connection, blockHeightMaxAge)
+	var ownerKeys *OwnerKeys
+	if ownerSigned != "" {
+		ownerKeys = NewOwnerKeys(connection, ownerSigned == "reject", ownerKeysMaxAge)
+		ownerKeys.BlockHeight = blockHeight
+	}
+	if stateSync != nil {
+		stateSync.URL = connection
+		stateSync.Contract = neardns
+		stateSync.OwnerKeys = ownerKeys
+		stateSync.BlockHeight = blockHeight
+	}
+	var xfr *ZoneTransfer
+	if zoneTransfer {
+		xfr = NewZoneTransfer(connection, transferPrefix)
+		xfr.Poll = transferPoll
+		xfr.Notifier = notifier
+	} else if notifier != nil {
+		return NEAR{}, false, c.Errf("invalid notify; zonetransfer is not enabled")
+	}
+
+	return NEAR{
+		Client:              &nearclient.Client{URL: connection},
+		NEARDNS:             neardns,
+		NEARLinkNameServers: nearLinkNameServers,
+		NameServerAddresses: nameServerAddresses,
+		IPFSGatewayAs:       ipfsGatewayAs,
+		IPFSGatewayAAAAs:    ipfsGatewayAAAAs,
+		GeoMap:              geoMap,
+		GatewayPools:        gatewayPools,
+		GatewayResolver:     gatewayResolver,
+		GatewayCNAME:        ipfsGatewayCNAME,
+		SubdomainGateway:    ipfsSubdomainGateway,
+		HTTPS:               httpsConfig,
+		Profile:             profile,
+		SOA:                 soaConfig,
+		TTL:                 ttlPolicy,
+		ApexAs:              apexAs,
+		ApexAAAAs:           apexAAAAs,
+		ApexTXTs:            apexTXTs,
+		DNSSEC:              dnssec,
+		KeyManager:          keyManager,
+		Zone:                zone,
+		BlockHeight:         blockHeight,
+		OwnerKeys:           ownerKeys,
+		ZoneTransfer:        xfr,
+		StateSync:           stateSync,
+		Delegations:         NewDelegationCache(defaultDelegationMaxAge),
+		RecordTypes:         NewRecordTypesCache(defaultRecordTypesMaxAge),
+	}, detectContractVersion, nil
+}
+
+// parseStatePrefix parses a prefix of the contract state, given as text for
+// prefix or in base64 for prefix64.
+func parseStatePrefix(key string, value string) ([]byte, error) {
+	if strings.EqualFold(key, "prefix64") {
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return []byte(value), nil
+}
+
+// parseTTL parses a TTL given in seconds or as a duration such as 5m or 1h.
+func parseTTL(value string) (uint32, error) {
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(seconds), nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Second || duration.Seconds() > float64(^uint32(0)) {
+		return 0, fmt.Errorf("invalid TTL %q", value)
+	}
+	return uint32(duration.Seconds()), nil
 }
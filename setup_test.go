@@ -1,9 +1,15 @@
 package near
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 )
 
 // TestSetup tests the various things that should be parsed by setup.
@@ -19,3 +25,441 @@ func TestSetup(t *testing.T) {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 }
+
+// setupBase is the minimal configuration that directives are tested in.
+const setupBase = "connection http://127.0.0.1:3030\nnearlinknameservers ns1.near.link\n"
+
+// parseTest is a configuration of directives and whether it is valid.
+type parseTest struct {
+	config string
+	valid  bool
+}
+
+// checkParse parses each configuration along with setupBase.
+func checkParse(t *testing.T, tests []parseTest) {
+	t.Helper()
+	for i, tt := range tests {
+		c := caddy.NewTestController("dns", "near {\n"+setupBase+tt.config+"\n}")
+		if _, _, err := nearParse(c); (err == nil) != tt.valid {
+			t.Errorf("Test %d: %q => %v (expected valid %v)", i, tt.config, err, tt.valid)
+		}
+	}
+}
+
+// parseConfig parses a valid configuration along with setupBase.
+func parseConfig(t *testing.T, config string) NEAR {
+	t.Helper()
+	c := caddy.NewTestController("dns", "near {\n"+setupBase+config+"\n}")
+	n, _, err := nearParse(c)
+	if err != nil {
+		t.Fatalf("%q => %v", config, err)
+	}
+	return n
+}
+
+func TestSetupGatewayPools(t *testing.T) {
+	geoMap := filepath.Join(t.TempDir(), "geo.map")
+	if err := os.WriteFile(geoMap, []byte("198.51.100.0/24 eu\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkParse(t, []parseTest{
+		{"ipfsgatewaypool 192.0.2.0/24 192.0.2.80 2001:db8::80", true},
+		{"geomap " + geoMap + "\nipfsgatewaypool eu 192.0.2.80", true},
+		{"ipfsgatewaypool eu 192.0.2.80", false},
+		{"ipfsgatewaypool eu", false},
+		{"ipfsgatewaypool 192.0.2.0/24 gateway.example.org", false},
+		{"geomap", false},
+		{"geomap " + geoMap + " " + geoMap, false},
+		{"geomap " + filepath.Join(t.TempDir(), "missing.map"), false},
+	})
+
+	n := parseConfig(t, "geomap "+geoMap+"\nipfsgatewaypool eu 192.0.2.80 2001:db8::80")
+	if pool := n.GatewayPools["eu"]; pool == nil || len(pool.As) != 1 || len(pool.AAAAs) != 1 {
+		t.Errorf("gateway pool eu => %v", pool)
+	}
+}
+
+func TestSetupGatewayResolver(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"ipfsgateway gateway.example.org\nipfsgatewayupstream 192.0.2.53", true},
+		{"ipfsgateway gateway.example.org\nipfsgatewayupstream 192.0.2.53:5353\nipfsgatewayrefresh 1m\nipfsgatewaycname", true},
+		{"ipfsgateway", false},
+		{"ipfsgatewayupstream", false},
+		{"ipfsgatewayupstream 192.0.2.53 192.0.2.54", false},
+		{"ipfsgatewayrefresh", false},
+		{"ipfsgatewayrefresh soon", false},
+		{"ipfsgatewayrefresh -1m", false},
+		{"ipfsgatewaycname", false},
+		{"ipfsgateway gateway.example.org\nipfsgatewayupstream 192.0.2.53\nipfsgatewaycname now", false},
+	})
+
+	n := parseConfig(t, "ipfsgateway Gateway.example.org\nipfsgatewayupstream 192.0.2.53\nipfsgatewaycname")
+	if n.GatewayResolver == nil || n.GatewayResolver.Names[0] != "gateway.example.org." || n.GatewayResolver.Upstream != "192.0.2.53:53" || !n.GatewayCNAME {
+		t.Errorf("gateway resolver => %+v, CNAME %v", n.GatewayResolver, n.GatewayCNAME)
+	}
+}
+
+func TestSetupSubdomainGateway(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"ipfssubdomaingateway", true},
+		{"ipfssubdomaingateway gateway.example.org", true},
+		{"ipfssubdomaingateway gateway.example.org dweb.link", false},
+	})
+
+	if n := parseConfig(t, "ipfssubdomaingateway"); n.SubdomainGateway != "dweb.link." {
+		t.Errorf("default subdomain gateway => %q (expected dweb.link.)", n.SubdomainGateway)
+	}
+	if n := parseConfig(t, "ipfssubdomaingateway Gateway.example.org"); n.SubdomainGateway != "gateway.example.org." {
+		t.Errorf("subdomain gateway => %q (expected gateway.example.org.)", n.SubdomainGateway)
+	}
+}
+
+func TestSetupHTTPS(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"ipfsgatewayhttps", true},
+		{"ipfsgatewayhttps alpn=h2 port=8443", true},
+		{"ipfsgatewayhttps alpn", false},
+		{"ipfsgatewayhttps alpn=", false},
+		{"ipfsgatewayhttps port=https", false},
+		{"ipfsgatewayhttps port=65536", false},
+		{"ipfsgatewayhttps ech=abc", false},
+	})
+
+	if n := parseConfig(t, "ipfsgatewayhttps"); n.HTTPS == nil || len(n.HTTPS.Alpn) != len(defaultHTTPSAlpn) || n.HTTPS.Port != 0 {
+		t.Errorf("default HTTPS config => %+v", n.HTTPS)
+	}
+	if n := parseConfig(t, "ipfsgatewayhttps alpn=h3,h2 port=8443"); n.HTTPS == nil || len(n.HTTPS.Alpn) != 2 || n.HTTPS.Port != 8443 {
+		t.Errorf("HTTPS config => %+v", n.HTTPS)
+	}
+}
+
+func TestSetupContractProfile(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"contractprofile neardns-records", true},
+		{"contractprofile auto", true},
+		{"contractprofile other", false},
+		{"contractprofile neardns neardns-records", false},
+		{"contractmethod a get_ipv4\ncontractmethod https -", true},
+		{"contractmethod mx get_mx", false},
+		{"contractmethod a", false},
+		{"contractargs account=account type=type key=name", true},
+		{"contractargs", false},
+		{"contractargs account", false},
+		{"contractargs account=", false},
+		{"contractargs owner=owner", false},
+		{"contractaccount full", true},
+		{"contractaccount long", false},
+		{"contracttype mnemonic", true},
+		{"contracttype name", false},
+		{"contractmetadata get_version", true},
+		{"contractmetadata", false},
+	})
+
+	n := parseConfig(t, "contractprofile neardns\ncontractmethod a get_ipv4\ncontractmethod https -\ncontractargs account=account\ncontractaccount full\ncontracttype mnemonic\ncontractmetadata get_version")
+	p := n.Profile
+	if p.Methods[kindA] != "get_ipv4" || p.Methods[kindHTTPS] != "" || p.AccountArg != "account" || p.AccountFormat != accountFull || p.TypeFormat != typeMnemonic || p.MetadataMethod != "get_version" {
+		t.Errorf("contract profile => %+v", p)
+	}
+	if _, detect, _ := nearParse(caddy.NewTestController("dns", "near {\n"+setupBase+"contractprofile auto\n}")); !detect {
+		t.Errorf("contractprofile auto does not detect the contract version")
+	}
+}
+
+func TestSetupContractResult(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"contractresult borsh", true},
+		{"contractresult object record", true},
+		{"contractresult xml", false},
+		{"contractresult", false},
+		{"contractresult object record extra", false},
+	})
+
+	if n := parseConfig(t, "contractresult Object record"); n.Profile.ResultEncoding != "object" || n.Profile.ResultField != "record" {
+		t.Errorf("contract result => %s %s", n.Profile.ResultEncoding, n.Profile.ResultField)
+	}
+}
+
+func TestSetupSOA(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"soa mname=ns1.near.link rname=hostmaster@near.link ttl=1h refresh=3600 retry=10m expire=336h minimum=300", true},
+		{"soa", false},
+		{"soa mname", false},
+		{"soa mname=", false},
+		{"soa ttl=forever", false},
+		{"soa serial=1", false},
+	})
+
+	n := parseConfig(t, "soa mname=NS1.near.link rname=hostmaster@near.link ttl=1h minimum=60")
+	if n.SOA.MName != "ns1.near.link." || n.SOA.RName != "hostmaster.near.link." || n.SOA.TTL != 3600 || n.SOA.Minimum != 60 {
+		t.Errorf("SOA config => %+v", n.SOA)
+	}
+}
+
+func TestSetupTTL(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"ttl default=300 min=60 max=24h", true},
+		{"ttl MX min=5m\nttl gateway max=60", true},
+		{"ttl", false},
+		{"ttl min", false},
+		{"ttl min=never", false},
+		{"ttl min=600 max=60", false},
+		{"ttl step=60", false},
+		{"ttl NOTATYPE min=60", false},
+	})
+
+	n := parseConfig(t, "ttl default=300\nttl mx min=5m\nttl gateway max=60")
+	if n.TTL.All.Default != 300 || n.TTL.Types[dns.TypeMX].Min != 300 || n.TTL.Gateway.Max != 60 {
+		t.Errorf("TTL policy => %+v", n.TTL)
+	}
+}
+
+func TestSetupApex(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"apexa 192.0.2.1 192.0.2.2\napexaaaa 2001:db8::1\napextxt \"v=spf1 -all\"", true},
+		{"apexa", false},
+		{"apexa 2001:db8::1", false},
+		{"apexaaaa", false},
+		{"apexaaaa 192.0.2.1", false},
+		{"apextxt", false},
+		{"apextxt " + strings.Repeat("a", 256), false},
+	})
+
+	n := parseConfig(t, "apexa 192.0.2.1\napexa 192.0.2.2\napextxt one two")
+	if len(n.ApexAs) != 2 || len(n.ApexTXTs) != 2 {
+		t.Errorf("apex records => %v %v", n.ApexAs, n.ApexTXTs)
+	}
+}
+
+func TestSetupNameServerAddresses(t *testing.T) {
+	tests := []struct {
+		config string
+		valid  bool
+	}{
+		{"nearlinknameservers ns1.near.link=192.0.2.53,2001:db8::53 ns2.example.org", true},
+		{"nearlinknameservers ns1.near.link=ns1.example.org", false},
+		{"nearlinknameservers", false},
+	}
+	for i, tt := range tests {
+		c := caddy.NewTestController("dns", "near {\nconnection http://127.0.0.1:3030\n"+tt.config+"\n}")
+		if _, _, err := nearParse(c); (err == nil) != tt.valid {
+			t.Errorf("Test %d: %q => %v (expected valid %v)", i, tt.config, err, tt.valid)
+		}
+	}
+
+	n := parseConfig(t, "nearlinknameservers ns1.near.link=192.0.2.53,2001:db8::53 ns2.example.org")
+	if len(n.NEARLinkNameServers) != 2 || n.NEARLinkNameServers[0] != "ns1.near.link." || len(n.NameServerAddresses["ns1.near.link."]) != 2 {
+		t.Errorf("nameservers => %v %v", n.NEARLinkNameServers, n.NameServerAddresses)
+	}
+}
+
+// writeTestKey writes a signing key for the zone to files in dir, as
+// dnssec-keygen does, and returns their base name.
+func writeTestKey(t *testing.T, dir string, zone string, flags uint16) string {
+	key, priv := newTestKey(t, zone, flags)
+	base := filepath.Join(dir, fmt.Sprintf("K%s+013+%05d", zone, key.Tag))
+	if err := os.WriteFile(base+".key", []byte(key.DNSKEY.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".private", []byte(key.DNSKEY.PrivateKeyString(priv)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func TestSetupDNSSEC(t *testing.T) {
+	dir := t.TempDir()
+	ksk := writeTestKey(t, dir, "near.link.", 257)
+	zsk := writeTestKey(t, dir, "near.link.", 256)
+	apexKey := writeTestKey(t, dir, "near.", 257)
+	checkParse(t, []parseTest{
+		{"zone near.link", true},
+		{"zone", false},
+		{"zone near.link example.org", false},
+		{"zone near..link", false},
+		{"zone near.link\ndnssec " + ksk + " " + zsk, true},
+		{"zone near.link\ndnssec " + ksk + ".key", true},
+		{"dnssec " + ksk, false},
+		{"zone near\ndnssec " + apexKey, false},
+		{"dnssec " + apexKey, false},
+		{"zone near.link\ndnssec " + apexKey, false},
+		{"zone near.link\ndnssec", false},
+		{"zone near.link\ndnssec " + filepath.Join(dir, "missing"), false},
+	})
+
+	n := parseConfig(t, "zone Near.Link\ndnssec "+ksk+" "+zsk)
+	if n.Zone != "near.link." || n.DNSSEC == nil {
+		t.Errorf("zone %s with DNSSEC %v", n.Zone, n.DNSSEC)
+	}
+}
+
+func TestSetupDNSSECKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	checkParse(t, []parseTest{
+		{"zone near.link\ndnsseckeys " + dir, true},
+		{"zone near.link\ndnsseckeys " + dir + " algorithm=ED25519 zsk=720h ksk=8760h prepublish=48h parent=192.0.2.53", true},
+		{"zone near.link\ndnsseckeys " + dir + " algorithm=13", true},
+		{"dnsseckeys " + dir, false},
+		{"zone near.link\ndnsseckeys", false},
+		{"zone near.link\ndnsseckeys " + dir + " algorithm", false},
+		{"zone near.link\ndnsseckeys " + dir + " algorithm=ROT13", false},
+		{"zone near.link\ndnsseckeys " + dir + " zsk=1d", false},
+		{"zone near.link\ndnsseckeys " + dir + " zsk=24h prepublish=48h", false},
+		{"zone near.link\ndnsseckeys " + dir + " rollover=24h", false},
+		{"zone near.link\ndnsseckeys " + dir + "\ndnssec " + writeTestKey(t, t.TempDir(), "near.link.", 257), false},
+	})
+
+	// Reading the configuration does not generate keys
+	n := parseConfig(t, "zone near.link\ndnsseckeys "+dir+" parent=192.0.2.53")
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("key directory created while reading the configuration: %v", err)
+	}
+	if n.KeyManager == nil || n.KeyManager.Parent != "192.0.2.53:53" || n.DNSSEC == nil {
+		t.Fatalf("key manager => %+v", n.KeyManager)
+	}
+	if err := n.KeyManager.Start(); err != nil {
+		t.Fatalf("failed to start key manager: %v", err)
+	}
+	defer n.KeyManager.Stop()
+	if len(n.DNSSEC.Keys()) != 2 {
+		t.Errorf("keys after startup => %v (expected a KSK and a ZSK)", n.DNSSEC.Keys())
+	}
+}
+
+func TestSetupOwnerSigned(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"ownersigned reject", true},
+		{"ownersigned FLAG", true},
+		{"ownersigned flag 10m", true},
+		{"ownersigned", false},
+		{"ownersigned drop", false},
+		{"ownersigned reject 10", false},
+		{"ownersigned reject -10m", false},
+		{"ownersigned reject 10m 20m", false},
+	})
+
+	n := parseConfig(t, "")
+	if n.OwnerKeys != nil {
+		t.Errorf("owner keys without ownersigned => %+v", n.OwnerKeys)
+	}
+	n = parseConfig(t, "ownersigned reject 10m")
+	if n.OwnerKeys == nil || !n.OwnerKeys.Reject || n.OwnerKeys.MaxAge != 10*time.Minute || n.OwnerKeys.BlockHeight != n.BlockHeight {
+		t.Errorf("owner keys => %+v", n.OwnerKeys)
+	}
+	n = parseConfig(t, "ownersigned flag")
+	if n.OwnerKeys == nil || n.OwnerKeys.Reject || n.OwnerKeys.MaxAge != defaultOwnerKeysMaxAge {
+		t.Errorf("owner keys => %+v", n.OwnerKeys)
+	}
+}
+
+func TestSetupZoneTransfer(t *testing.T) {
+	keyDir := t.TempDir()
+	checkParse(t, []parseTest{
+		{"zonetransfer", true},
+		{"zonetransfer prefix=r poll=10s", true},
+		{"zonetransfer prefix64=cg==", true},
+		{"zonetransfer prefix", false},
+		{"zonetransfer prefix64=!", false},
+		{"zonetransfer poll=10", false},
+		{"zonetransfer poll=0s", false},
+		{"zonetransfer interval=10s", false},
+		{"zone near.link\nzonetransfer\ndnssec " + writeTestKey(t, keyDir, "near.link.", 257), false},
+		{"zone near.link\nzonetransfer\ndnsseckeys " + filepath.Join(keyDir, "managed"), false},
+	})
+
+	n := parseConfig(t, "")
+	if n.ZoneTransfer != nil {
+		t.Errorf("zone transfer without zonetransfer => %+v", n.ZoneTransfer)
+	}
+	n = parseConfig(t, "zonetransfer prefix64=cg== poll=10s")
+	if n.ZoneTransfer == nil || string(n.ZoneTransfer.Prefix) != "r" || n.ZoneTransfer.Poll != 10*time.Second || n.ZoneTransfer.URL != "http://127.0.0.1:3030" {
+		t.Errorf("zone transfer => %+v", n.ZoneTransfer)
+	}
+	n = parseConfig(t, "zonetransfer")
+	if n.ZoneTransfer == nil || n.ZoneTransfer.Poll != defaultZonePoll {
+		t.Errorf("zone transfer => %+v", n.ZoneTransfer)
+	}
+}
+
+func TestSetupNotify(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"zonetransfer\nnotify 192.0.2.53", true},
+		{"zonetransfer\nnotify 192.0.2.53 ns2.example.org:5353 retries=0 timeout=1s allow=192.0.2.0/24,2001:db8::/32", true},
+		{"notify 192.0.2.53", false},
+		{"zonetransfer\nnotify", false},
+		{"zonetransfer\nnotify retries=3", false},
+		{"zonetransfer\nnotify 192.0.2.53 retries=-1", false},
+		{"zonetransfer\nnotify 192.0.2.53 timeout=5", false},
+		{"zonetransfer\nnotify 192.0.2.53 allow=192.0.2.1", false},
+		{"zonetransfer\nnotify 192.0.2.53 interval=5s", false},
+	})
+
+	n := parseConfig(t, "zonetransfer\nnotify 192.0.2.53 [2001:db8::53]:5353 ns2.example.org retries=1 allow=192.0.2.0/24")
+	notifier := n.ZoneTransfer.Notifier
+	if notifier == nil {
+		t.Fatal("notify => no notifier")
+	}
+	secondaries := strings.Join(notifier.Secondaries, " ")
+	if secondaries != "192.0.2.53:53 [2001:db8::53]:5353 ns2.example.org:53" {
+		t.Errorf("notify secondaries => %s", secondaries)
+	}
+	if notifier.Retries != 1 || notifier.Timeout != defaultNotifyTimeout || len(notifier.Allow) != 1 || notifier.Allow[0].String() != "192.0.2.0/24" {
+		t.Errorf("notifier => %+v", notifier)
+	}
+}
+
+func TestSetupStateSync(t *testing.T) {
+	checkParse(t, []parseTest{
+		{"statesync", true},
+		{"statesync prefix=r poll=500ms lag=0", true},
+		{"statesync prefix64=cg==", true},
+		{"statesync prefix", false},
+		{"statesync prefix64=!", false},
+		{"statesync poll=1", false},
+		{"statesync poll=-1s", false},
+		{"statesync lag=-1", false},
+		{"statesync lag=ten", false},
+		{"statesync interval=1s", false},
+	})
+
+	n := parseConfig(t, "")
+	if n.StateSync != nil {
+		t.Errorf("state sync without statesync => %+v", n.StateSync)
+	}
+	n = parseConfig(t, "ownersigned reject\nstatesync prefix=r poll=500ms lag=3")
+	s := n.StateSync
+	if s == nil || string(s.Prefix) != "r" || s.Poll != 500*time.Millisecond || s.MaxLag != 3 {
+		t.Fatalf("state sync => %+v", s)
+	}
+	if s.URL != "http://127.0.0.1:3030" || s.Contract != n.NEARDNS || s.OwnerKeys != n.OwnerKeys || s.BlockHeight != n.BlockHeight {
+		t.Errorf("state sync => %+v", s)
+	}
+	n = parseConfig(t, "statesync")
+	if n.StateSync == nil || n.StateSync.Poll != defaultSyncPoll || n.StateSync.MaxLag != defaultSyncLag {
+		t.Errorf("state sync => %+v", n.StateSync)
+	}
+}
+
+func TestSetupSnapshot(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "near-index.json")
+	checkParse(t, []parseTest{
+		{"statesync snapshot=" + snapshot, true},
+		{"statesync snapshot=" + snapshot + " checkpoint=30s snapshotage=2h", true},
+		{"statesync checkpoint=0s", false},
+		{"statesync checkpoint=1", false},
+		{"statesync snapshotage=-1h", false},
+		{"statesync snapshotage=1", false},
+	})
+
+	n := parseConfig(t, "statesync snapshot="+snapshot+" checkpoint=30s snapshotage=2h")
+	s := n.StateSync
+	if s == nil || s.Snapshot != snapshot || s.Checkpoint != 30*time.Second || s.MaxSnapshotAge != 2*time.Hour {
+		t.Errorf("state sync => %+v", s)
+	}
+	if _, err := os.Stat(snapshot); !os.IsNotExist(err) {
+		t.Errorf("snapshot written while reading the configuration: %v", err)
+	}
+	n = parseConfig(t, "statesync snapshot="+snapshot)
+	if n.StateSync == nil || n.StateSync.Checkpoint != defaultCheckpoint || n.StateSync.MaxSnapshotAge != defaultSnapshotMaxAge {
+		t.Errorf("state sync => %+v", n.StateSync)
+	}
+}
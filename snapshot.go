@@ -0,0 +1,132 @@
+package near
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// defaultCheckpoint is how often the index is written to its snapshot.
+	defaultCheckpoint = time.Minute
+	// snapshotGrace is how long a restored snapshot is answered from while
+	// it is brought up to date with the chain.
+	snapshotGrace = 5 * time.Minute
+	// defaultSnapshotMaxAge is how old a snapshot can be by default to be
+	// restored.
+	defaultSnapshotMaxAge = time.Hour
+)
+
+// indexSnapshot is the index of a state sync as written to disk.
+type indexSnapshot struct {
+	Contract    string                     `json:"contract"`
+	Prefix      []byte                     `json:"prefix"`
+	BlockHeight uint64                     `json:"block_height"`
+	Saved       time.Time                  `json:"saved"`
+	Accounts    map[string]snapshotAccount `json:"accounts"`
+}
+
+// snapshotAccount is an indexed account in a snapshot.
+type snapshotAccount struct {
+	ContentHash []byte          `json:"content_hash,omitempty"`
+	RRSets      []snapshotRRSet `json:"rrsets,omitempty"`
+}
+
+// snapshotRRSet is an indexed record set in a snapshot.
+type snapshotRRSet struct {
+	Type  uint16 `json:"type"`
+	Key   string `json:"key,omitempty"`
+	Value []byte `json:"value"`
+}
+
+// checkpoint writes the index to the snapshot file if it has changed since
+// it was last written.
+func (s *StateSync) checkpoint() error {
+	if s.Snapshot == "" {
+		return nil
+	}
+	s.mu.RLock()
+	if s.height == 0 || s.height == s.checkpointed {
+		s.mu.RUnlock()
+		return nil
+	}
+	snapshot := indexSnapshot{
+		Contract:    s.Contract,
+		Prefix:      s.Prefix,
+		BlockHeight: s.height,
+		Saved:       time.Now().UTC(),
+		Accounts:    make(map[string]snapshotAccount, len(s.accounts)),
+	}
+	for domain, account := range s.accounts {
+		saved := snapshotAccount{ContentHash: account.contentHash}
+		for rrSetKey, value := range account.rrSets {
+			saved.RRSets = append(saved.RRSets, snapshotRRSet{Type: rrSetKey.qtype, Key: rrSetKey.key, Value: value})
+		}
+		sort.Slice(saved.RRSets, func(i, j int) bool {
+			if saved.RRSets[i].Key != saved.RRSets[j].Key {
+				return saved.RRSets[i].Key < saved.RRSets[j].Key
+			}
+			return saved.RRSets[i].Type < saved.RRSets[j].Type
+		})
+		snapshot.Accounts[domain] = saved
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(s.Snapshot, string(data)); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.checkpointed = snapshot.BlockHeight
+	s.mu.Unlock()
+	return nil
+}
+
+// restore loads the index from the snapshot file, if there is one for the
+// contract and prefix that was saved within MaxSnapshotAge.  The restored
+// index is answered from until it has been brought up to date, for up to
+// snapshotGrace, unless it turns out to be too far behind the chain.
+func (s *StateSync) restore() error {
+	data, err := os.ReadFile(s.Snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot indexSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %v", s.Snapshot, err)
+	}
+	if snapshot.Contract != s.Contract || !bytes.Equal(snapshot.Prefix, s.Prefix) {
+		return fmt.Errorf("snapshot %s is of another contract or prefix", s.Snapshot)
+	}
+	if age := time.Since(snapshot.Saved); age > s.MaxSnapshotAge {
+		return fmt.Errorf("snapshot %s was saved %s ago (more than %s)", s.Snapshot, age.Round(time.Second), s.MaxSnapshotAge)
+	}
+
+	accounts := make(map[string]*indexedAccount, len(snapshot.Accounts))
+	for domain, saved := range snapshot.Accounts {
+		index(accounts, stateRecord{domain: domain, value: saved.ContentHash})
+		for _, rrSet := range saved.RRSets {
+			index(accounts, stateRecord{domain: domain, qtype: rrSet.Type, key: rrSet.Key, value: rrSet.Value})
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts = accounts
+	s.height = snapshot.BlockHeight
+	s.checkpointed = snapshot.BlockHeight
+	s.restored = time.Now()
+	log.Infof("restored %d accounts of %s at block %d from %s", len(accounts), s.Contract, snapshot.BlockHeight, s.Snapshot)
+	return nil
+}
@@ -0,0 +1,103 @@
+package near
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSnapshot(t *testing.T) {
+	node := &stateNode{
+		head: 100,
+		state: map[string]string{
+			"ralice:contenthash": "e3010170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f",
+			"ralice:A":           "@ 300 IN A 192.0.2.1",
+			"ralice:TXT:_dmarc":  "@ 300 IN TXT \"v=DMARC1\"",
+		},
+		changes: map[uint64][]stateChange{
+			101: {change("dns.near", "ralice:A", "@ 300 IN A 192.0.2.2")},
+		},
+	}
+	server := httptest.NewServer(node)
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "index.json")
+
+	s := NewStateSync(server.URL, "dns.near", []byte("r"))
+	s.Snapshot = path
+	s.sync()
+	if err := s.checkpoint(); err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+
+	// A restarted sync answers from the snapshot before reading the chain
+	restarted := NewStateSync(server.URL, "dns.near", []byte("r"))
+	restarted.Snapshot = path
+	if err := restarted.restore(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if value, ok := restarted.Lookup(kindA, "alice.near.", dns.TypeA, ""); !ok || string(value) != "@ 300 IN A 192.0.2.1" {
+		t.Errorf("A of alice.near from snapshot => %q, %v", value, ok)
+	}
+	if value, ok := restarted.Lookup(kindRecords, "alice.near.", dns.TypeTXT, "_dmarc"); !ok || string(value) != "@ 300 IN TXT \"v=DMARC1\"" {
+		t.Errorf("TXT of _dmarc.alice.near from snapshot => %q, %v", value, ok)
+	}
+	if value, ok := restarted.Lookup(kindContentHash, "alice.near.", dns.TypeNone, ""); !ok || len(value) == 0 {
+		t.Errorf("content hash of alice.near from snapshot => %q, %v", value, ok)
+	}
+
+	// The restored index is answered from while it lags, until it is up
+	// to date
+	restarted.mu.Lock()
+	restarted.head = 100 + restarted.MaxLag + 1
+	restarted.mu.Unlock()
+	if _, ok := restarted.Lookup(kindA, "alice.near.", dns.TypeA, ""); !ok {
+		t.Errorf("Lookup of a lagging restored index failed")
+	}
+	restarted.mu.Lock()
+	restarted.head = 100 + syncCatchUpBlocks + 1
+	restarted.mu.Unlock()
+	if _, ok := restarted.Lookup(kindA, "alice.near.", dns.TypeA, ""); ok {
+		t.Errorf("Lookup of a restored index too far behind the chain succeeded")
+	}
+	restarted.mu.Lock()
+	restarted.head = 100
+	restarted.mu.Unlock()
+	restarted.mu.Lock()
+	restarted.restored = time.Now().Add(-snapshotGrace)
+	restarted.mu.Unlock()
+	if _, ok := restarted.Lookup(kindA, "alice.near.", dns.TypeA, ""); ok {
+		t.Errorf("Lookup of a restored index past its grace succeeded")
+	}
+
+	node.head = 101
+	restarted.sync()
+	if node.loads != 1 {
+		t.Errorf("state read %d times (expected once, before the restart)", node.loads)
+	}
+	if value, ok := restarted.Lookup(kindA, "alice.near.", dns.TypeA, ""); !ok || string(value) != "@ 300 IN A 192.0.2.2" {
+		t.Errorf("A of alice.near after revalidation => %q, %v", value, ok)
+	}
+	if !restarted.restored.IsZero() {
+		t.Errorf("index is still marked as restored after revalidation")
+	}
+
+	other := NewStateSync(server.URL, "other.near", []byte("r"))
+	other.Snapshot = path
+	if err := other.restore(); err == nil {
+		t.Errorf("snapshot of another contract was restored")
+	}
+	stale := NewStateSync(server.URL, "dns.near", []byte("r"))
+	stale.Snapshot = path
+	stale.MaxSnapshotAge = time.Nanosecond
+	if err := stale.restore(); err == nil || stale.height != 0 {
+		t.Errorf("snapshot older than the maximum age was restored")
+	}
+	missing := NewStateSync(server.URL, "dns.near", []byte("r"))
+	missing.Snapshot = filepath.Join(t.TempDir(), "missing.json")
+	if err := missing.restore(); err != nil {
+		t.Errorf("restore without a snapshot failed: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package near
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// SOAConfig holds the fields of synthesized SOA records.  Empty names and
+// zero timers take their defaults.
+type SOAConfig struct {
+	// MName is the primary nameserver; it defaults to the first of the
+	// NEARLink nameservers.
+	MName string
+	// RName is the mailbox of the zone administrator; it defaults to
+	// hostmaster at the zone.
+	RName   string
+	TTL     uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// defaultSOA holds the default SOA fields.
+var defaultSOA = SOAConfig{
+	TTL:     10800,
+	Refresh: 3600,
+	Retry:   600,
+	Expire:  1209600,
+	Minimum: 300,
+}
+
+// soaConfig returns the configured SOA fields with defaults filled in.
+func (n NEAR) soaConfig() SOAConfig {
+	config := defaultSOA
+	if n.SOA != nil {
+		config = *n.SOA
+		if config.TTL == 0 {
+			config.TTL = defaultSOA.TTL
+		}
+		if config.Refresh == 0 {
+			config.Refresh = defaultSOA.Refresh
+		}
+		if config.Retry == 0 {
+			config.Retry = defaultSOA.Retry
+		}
+		if config.Expire == 0 {
+			config.Expire = defaultSOA.Expire
+		}
+		if config.Minimum == 0 {
+			config.Minimum = defaultSOA.Minimum
+		}
+	}
+	if config.MName == "" && len(n.NEARLinkNameServers) > 0 {
+		config.MName = dns.Fqdn(n.NEARLinkNameServers[0])
+	}
+	return config
+}
+
+// serial returns the SOA serial, which is the latest final NEAR block height.
+// Block heights only increase, so the serial does too.  Until the height is
+// first known the serial is 0, which is not served, as any placeholder would
+// be lower than the serial served before a restart.  The height is kept current in the
+// background, so this does not wait on the NEAR node.  With zone transfers
+// the serial is that of the transferred zone, which only changes with its
+// records.
+func (n NEAR) serial() uint32 {
+	if n.ZoneTransfer != nil {
+		if serial, ok := n.ZoneTransfer.serial(); ok {
+			return serial
+		}
+	}
+	if n.BlockHeight == nil {
+		return 1
+	}
+	return uint32(n.BlockHeight.Height())
+}
+
+// handleSOA creates the SOA record of the zone at domain, which is the zone
+// apex.
+func (n NEAR) handleSOA(name string, domain string, contentHash []byte) ([]dns.RR, error) {
+	serial := n.serial()
+	if serial == 0 {
+		return make([]dns.RR, 0), errors.New("NEAR block height is not known")
+	}
+	return n.soaRecord(domain, serial), nil
+}
+
+// soaRecord creates the SOA record of the zone at domain with a serial.
+func (n NEAR) soaRecord(domain string, serial uint32) []dns.RR {
+	results := make([]dns.RR, 0)
+	config := n.soaConfig()
+	if config.MName == "" {
+		return results
+	}
+	rname := config.RName
+	if rname == "" {
+		rname = "hostmaster." + domain
+	}
+
+	results = append(results, &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   domain,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    config.TTL,
+		},
+		Ns:      config.MName,
+		Mbox:    rname,
+		Serial:  serial,
+		Refresh: config.Refresh,
+		Retry:   config.Retry,
+		Expire:  config.Expire,
+		Minttl:  config.Minimum,
+	})
+	return results
+}
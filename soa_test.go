@@ -0,0 +1,131 @@
+package near
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandleSOA(t *testing.T) {
+	tests := []struct {
+		soa    *SOAConfig
+		record string
+	}{
+		{nil, "near. 10800 IN SOA ns1.neardns.xyz. hostmaster.near. 1 3600 600 1209600 300"},
+		{&SOAConfig{MName: "ns.example.org.", RName: "dns.example.org.", TTL: 3600, Minimum: 60}, "near. 3600 IN SOA ns.example.org. dns.example.org. 1 3600 600 1209600 60"},
+	}
+	for i, tt := range tests {
+		n := NEAR{NEARLinkNameServers: []string{"ns1.neardns.xyz.", "ns2.neardns.xyz."}, SOA: tt.soa}
+		results, err := n.handleSOA(zoneApex, zoneApex, nil)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error %v", i, err)
+		}
+		if len(results) != 1 || !dns.IsDuplicate(results[0], newRR(tt.record)) {
+			t.Errorf("Test %d: got %v (expected %v)", i, results, tt.record)
+		}
+	}
+}
+
+func TestAccountSOA(t *testing.T) {
+	n := indexedNEAR(t, map[string]string{
+		"alice:contenthash": testContentHash,
+		"alice:A":           "@ 300 IN A 192.0.2.1",
+	})
+	n.Zone = "near.link."
+	apexSOA := func(rrs []dns.RR) bool {
+		return len(rrs) == 1 && rrs[0].Header().Rrtype == dns.TypeSOA && rrs[0].Header().Name == "near.link."
+	}
+
+	// Accounts have no SOA of their own
+	a := serve(t, n, "alice.near.link.", dns.TypeSOA, false)
+	if len(a.Answer) != 0 || !apexSOA(a.Ns) {
+		t.Errorf("SOA of alice.near.link. => %v, authority %v (expected the apex SOA in the authority)", a.Answer, a.Ns)
+	}
+	a = serve(t, n, "near.link.", dns.TypeSOA, false)
+	if !apexSOA(a.Answer) {
+		t.Errorf("SOA of near.link. => %v", a.Answer)
+	}
+
+	// Negative answers for names of accounts carry the apex SOA
+	for _, name := range []string{"alice.near.link.", "_dmarc.alice.near.link.", "bob.near.link."} {
+		a = serve(t, n, name, dns.TypeMX, false)
+		if len(a.Answer) != 0 || !apexSOA(a.Ns) {
+			t.Errorf("MX of %s => %v, authority %v (expected the apex SOA in the authority)", name, a.Answer, a.Ns)
+		}
+	}
+}
+
+func TestBlockHeight(t *testing.T) {
+	height := 100
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"method":"block"`) {
+			t.Errorf("unexpected request %s", body)
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"coredns-near","result":{"header":{"height":%d}}}`, height)
+	}))
+	defer server.Close()
+
+	n := NEAR{NEARLinkNameServers: []string{"ns1.neardns.xyz."}, BlockHeight: NewBlockHeight(server.URL, time.Hour)}
+	if serial := n.serial(); serial != 0 {
+		t.Errorf("Expected no serial before the height is known, got %d", serial)
+	}
+	if _, err := n.handleSOA(zoneApex, zoneApex, nil); err == nil {
+		t.Errorf("Expected no SOA before the height is known")
+	}
+	n.BlockHeight.refresh()
+	if serial := n.serial(); serial != 100 {
+		t.Errorf("Expected serial 100, got %d", serial)
+	}
+	// The cached height is used until it is refreshed
+	height = 200
+	if serial := n.serial(); serial != 100 {
+		t.Errorf("Expected cached serial 100, got %d", serial)
+	}
+	// The serial never decreases
+	height = 50
+	n.BlockHeight.refresh()
+	if serial := n.serial(); serial != 100 {
+		t.Errorf("Expected serial 100, got %d", serial)
+	}
+	height = 300
+	n.BlockHeight.refresh()
+	if serial := n.serial(); serial != 300 {
+		t.Errorf("Expected serial 300, got %d", serial)
+	}
+
+	// Started, the height is known at once
+	started := NewBlockHeight(server.URL, time.Hour)
+	started.Start()
+	defer started.Stop()
+	if height := started.Height(); height != 300 {
+		t.Errorf("Expected height 300 after starting, got %d", height)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		value string
+		ttl   uint32
+		err   bool
+	}{
+		{"300", 300, false},
+		{"5m", 300, false},
+		{"1h30m", 5400, false},
+		{"500ms", 0, true},
+		{"-1", 0, true},
+		{"forever", 0, true},
+	}
+	for _, tt := range tests {
+		ttl, err := parseTTL(tt.value)
+		if (err != nil) != tt.err || ttl != tt.ttl {
+			t.Errorf("parseTTL(%q) = %d, %v", tt.value, ttl, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package near
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// stateContentHash is the record type in state keys that holds the content
+// hash of an account.
+const stateContentHash = "contenthash"
+
+// stateEntry is a key and value of the contract state.
+type stateEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// stateRecord is a record set, or a content hash if qtype is TypeNone,
+// stored in the contract state.
+type stateRecord struct {
+	domain string
+	qtype  uint16
+	key    string
+	value  []byte
+}
+
+// name returns the owner name of the record set.
+func (r stateRecord) name() string {
+	if r.key == "" {
+		return r.domain
+	}
+	return r.key + "." + r.domain
+}
+
+// readContractState reads the entries of the contract state of account below
+// prefix and the block height they were read at.
+func readContractState(url string, account string, prefix []byte) ([]stateEntry, uint64, error) {
+	var result struct {
+		Values      []stateEntry `json:"values"`
+		BlockHeight uint64       `json:"block_height"`
+	}
+	params := map[string]string{
+		"request_type":  "view_state",
+		"finality":      "final",
+		"account_id":    account,
+		"prefix_base64": base64.StdEncoding.EncodeToString(prefix),
+	}
+	if err := rpcCall(url, "query", params, &result); err != nil {
+		if strings.Contains(err.Error(), "TOO_LARGE_CONTRACT_STATE") || strings.Contains(err.Error(), "too large") {
+			// Nodes only serve view_state up to trie_viewer_state_size_limit
+			// (50 kB by default)
+			return nil, 0, fmt.Errorf("state of %s below prefix %q exceeds the view_state size limit of the NEAR node; use a node with a higher trie_viewer_state_size_limit or a narrower prefix: %v", account, prefix, err)
+		}
+		return nil, 0, err
+	}
+	return result.Values, result.BlockHeight, nil
+}
+
+// decodeStateEntry decodes an entry of the contract state, with its key and
+// value in base64.  Record sets are stored under keys that start with prefix
+// followed by "<account>:<type>" or "<account>:<type>:<key>", either as is
+// or as a Borsh string, with the record set as the value, either as is or as
+// a Borsh byte vector.  The content hash of an account is stored as the
+// type "contenthash".
+func decodeStateEntry(prefix []byte, key string, value string) (stateRecord, error) {
+	stateKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return stateRecord{}, err
+	}
+	record, err := parseStateKey(prefix, stateKey)
+	if err != nil {
+		return stateRecord{}, err
+	}
+	if record.value, err = base64.StdEncoding.DecodeString(value); err != nil {
+		return stateRecord{}, err
+	}
+	if decoded, err := decodeBorsh(record.value, ""); err == nil {
+		record.value = decoded
+	}
+	return record, nil
+}
+
+// parseStateKey splits a state key below the prefix into the account domain,
+// record type and record key.
+func parseStateKey(prefix []byte, stateKey []byte) (stateRecord, error) {
+	if !bytes.HasPrefix(stateKey, prefix) {
+		return stateRecord{}, errors.New("key outside the records prefix")
+	}
+	key := stateKey[len(prefix):]
+	if len(key) >= 4 && uint64(binary.LittleEndian.Uint32(key))+4 == uint64(len(key)) {
+		// Borsh string
+		key = key[4:]
+	}
+	parts := strings.SplitN(string(key), ":", 3)
+	if len(parts) < 2 {
+		return stateRecord{}, fmt.Errorf("malformed key %q", key)
+	}
+
+	account := strings.ToLower(strings.TrimSuffix(parts[0], ".near"))
+	record := stateRecord{domain: account + "." + zoneApex}
+	if !validAccount(record.domain) {
+		return stateRecord{}, fmt.Errorf("invalid account in key %q", key)
+	}
+	if strings.EqualFold(parts[1], stateContentHash) {
+		if len(parts) == 3 {
+			return stateRecord{}, fmt.Errorf("content hash with a record key in key %q", key)
+		}
+		return record, nil
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(parts[1])]
+	if !ok {
+		number, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil || number == 0 {
+			return stateRecord{}, fmt.Errorf("invalid record type in key %q", key)
+		}
+		qtype = uint16(number)
+	}
+	record.qtype = qtype
+	if len(parts) == 3 {
+		record.key = strings.ToLower(parts[2])
+	}
+	return record, nil
+}
@@ -0,0 +1,38 @@
+package near
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseStateKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		domain string
+		qtype  uint16
+		rrKey  string
+		valid  bool
+	}{
+		{"ralice:A", "alice.near.", dns.TypeA, "", true},
+		{"r" + string(borshString("alice.near:mx")), "alice.near.", dns.TypeMX, "", true},
+		{"rbob:16:_Dmarc", "bob.near.", dns.TypeTXT, "_dmarc", true},
+		{"rbob:contenthash", "bob.near.", dns.TypeNone, "", true},
+		{"rbob:contenthash:www", "", 0, "", false},
+		{"ralice", "", 0, "", false},
+		{"ralice:BOGUS", "", 0, "", false},
+		{"ralice:0", "", 0, "", false},
+		{"r:A", "", 0, "", false},
+		{"xalice:A", "", 0, "", false},
+	}
+	for _, tt := range tests {
+		record, err := parseStateKey([]byte("r"), []byte(tt.key))
+		if (err == nil) != tt.valid {
+			t.Errorf("Failure: %q => %v (expected valid %v)\n", tt.key, err, tt.valid)
+			continue
+		}
+		if tt.valid && (record.domain != tt.domain || record.qtype != tt.qtype || record.key != tt.rrKey) {
+			t.Errorf("Failure: %q => %s %d %q (expected %s %d %q)\n", tt.key, record.domain, record.qtype, record.key, tt.domain, tt.qtype, tt.rrKey)
+		}
+	}
+}
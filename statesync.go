@@ -0,0 +1,410 @@
+package near
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultSyncPoll is how often the state sync checks for new blocks.
+	defaultSyncPoll = time.Second
+	// defaultSyncLag is the number of blocks the index can fall behind the
+	// chain before queries fall back to the contract.
+	defaultSyncLag = 10
+	// syncCatchUpBlocks is the number of blocks the index is brought up to
+	// date with block by block; further behind, the state is read again.
+	syncCatchUpBlocks = 300
+	// syncStalePolls is the number of poll intervals without a successful
+	// poll after which the index is no longer trusted.
+	syncStalePolls = 10
+)
+
+// StateSync keeps a local index of the records in the contract state, so
+// that queries are answered without calls to the NEAR node.  The state below
+// Prefix (see decodeStateEntry) is read in full at startup and kept current
+// with the changes of every new final block, polled every Poll interval.
+// While the index lags more than MaxLag blocks behind the chain, or has not
+// been brought up to date for a while, queries fall back to the contract.
+//
+// With OwnerKeys the index holds values as signed in the contract, and their
+// signatures are verified when they are looked up and again whenever the
+// access keys of their account may have changed, after OwnerKeys.MaxAge, so
+// that values signed with revoked keys stop being answered.
+type StateSync struct {
+	URL       string
+	Contract  string
+	Prefix    []byte
+	Poll      time.Duration
+	MaxLag    uint64
+	OwnerKeys *OwnerKeys
+	// BlockHeight, if set, is kept current with the heights seen.
+	BlockHeight *BlockHeight
+	// Snapshot, if set, is the file the index is written to every
+	// Checkpoint interval and on shutdown, and restored from at startup.
+	Snapshot   string
+	Checkpoint time.Duration
+	// MaxSnapshotAge is how old a snapshot can be to be restored.
+	MaxSnapshotAge time.Duration
+
+	mu           sync.RWMutex
+	accounts     map[string]*indexedAccount
+	height       uint64
+	head         uint64
+	synced       time.Time
+	restored     time.Time
+	checkpointed uint64
+	stop         chan struct{}
+
+	verifiedMu sync.Mutex
+	verified   map[verifiedKey]verifiedValue
+}
+
+// verifiedKey identifies a value of an account in the index.
+type verifiedKey struct {
+	domain string
+	qtype  uint16
+	key    string
+}
+
+// verifiedValue is the value carried by a signed value of the index, as of
+// when its signature was verified.
+type verifiedValue struct {
+	signed   []byte
+	value    []byte
+	verified time.Time
+}
+
+// indexedAccount holds the content hash and record sets of an account.
+type indexedAccount struct {
+	contentHash []byte
+	rrSets      map[indexKey][]byte
+}
+
+// indexKey identifies a record set of an account.
+type indexKey struct {
+	qtype uint16
+	key   string
+}
+
+// stateChange is a change of the contract state in a block.
+type stateChange struct {
+	Type   string `json:"type"`
+	Change struct {
+		AccountID string `json:"account_id"`
+		Key       string `json:"key_base64"`
+		Value     string `json:"value_base64"`
+	} `json:"change"`
+}
+
+// NewStateSync creates a state sync of the contract through the NEAR node at
+// url.
+func NewStateSync(url string, contract string, prefix []byte) *StateSync {
+	return &StateSync{
+		URL:        url,
+		Contract:   contract,
+		Prefix:     prefix,
+		Poll:       defaultSyncPoll,
+		MaxLag:     defaultSyncLag,
+		Checkpoint: defaultCheckpoint,
+
+		MaxSnapshotAge: defaultSnapshotMaxAge,
+	}
+}
+
+// Start restores the index from its snapshot, if there is one, and starts
+// syncing it in the background.  Queries are answered from the contract
+// until the state has been read or restored.
+func (s *StateSync) Start() error {
+	if s.Snapshot != "" {
+		if err := s.restore(); err != nil {
+			log.Warnf("failed to restore state of %s: %v", s.Contract, err)
+		}
+	}
+	s.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		s.sync()
+		ticker := time.NewTicker(s.Poll)
+		defer ticker.Stop()
+		checkpoints := time.NewTicker(s.Checkpoint)
+		defer checkpoints.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.sync()
+			case <-checkpoints.C:
+				if err := s.checkpoint(); err != nil {
+					log.Warnf("failed to write snapshot of %s: %v", s.Contract, err)
+				}
+			}
+		}
+	}(s.stop)
+	return nil
+}
+
+// Stop stops syncing the index and writes its snapshot.
+func (s *StateSync) Stop() error {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	return s.checkpoint()
+}
+
+// sync brings the index up to date with the latest final block.
+func (s *StateSync) sync() {
+	head, err := finalBlockHeight(s.URL)
+	if err != nil {
+		log.Warnf("failed to obtain NEAR block height for state sync: %v", err)
+		return
+	}
+	if s.BlockHeight != nil {
+		s.BlockHeight.Observe(head)
+	}
+	s.mu.Lock()
+	s.head = head
+	height := s.height
+	s.mu.Unlock()
+
+	if height == 0 || head > height+syncCatchUpBlocks {
+		if err := s.load(); err != nil {
+			log.Warnf("failed to read state of %s: %v", s.Contract, err)
+		}
+		return
+	}
+	for block := height + 1; block <= head; block++ {
+		changes, err := s.changes(block)
+		if err != nil {
+			log.Warnf("failed to read state changes of %s at block %d: %v", s.Contract, block, err)
+			return
+		}
+		records := make([]stateRecord, 0, len(changes))
+		for _, change := range changes {
+			if record, ok := s.changeRecord(change); ok {
+				records = append(records, record)
+			}
+		}
+		s.verifiedMu.Lock()
+		for _, record := range records {
+			delete(s.verified, verifiedKey{record.domain, record.qtype, record.key})
+		}
+		s.verifiedMu.Unlock()
+		s.mu.Lock()
+		for _, record := range records {
+			index(s.accounts, record)
+		}
+		s.height = block
+		s.synced = time.Now()
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.synced = time.Now()
+	s.restored = time.Time{}
+	s.mu.Unlock()
+}
+
+// load replaces the index with the full contract state.
+func (s *StateSync) load() error {
+	entries, height, err := readContractState(s.URL, s.Contract, s.Prefix)
+	if err != nil {
+		return err
+	}
+	accounts := make(map[string]*indexedAccount)
+	for _, entry := range entries {
+		record, err := decodeStateEntry(s.Prefix, entry.Key, entry.Value)
+		if err != nil {
+			log.Debugf("skipping state entry: %v", err)
+			continue
+		}
+		index(accounts, record)
+	}
+
+	s.verifiedMu.Lock()
+	s.verified = nil
+	s.verifiedMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts = accounts
+	s.height = height
+	if height > s.head {
+		s.head = height
+	}
+	s.synced = time.Now()
+	s.restored = time.Time{}
+	log.Infof("indexed %d accounts of %s at block %d", len(accounts), s.Contract, height)
+	return nil
+}
+
+// changes reads the changes of the contract state in a block.  Heights
+// without a block have no changes.
+func (s *StateSync) changes(block uint64) ([]stateChange, error) {
+	var result struct {
+		Changes []stateChange `json:"changes"`
+	}
+	params := map[string]interface{}{
+		"changes_type":      "data_changes",
+		"account_ids":       []string{s.Contract},
+		"key_prefix_base64": base64.StdEncoding.EncodeToString(s.Prefix),
+		"block_id":          block,
+	}
+	if err := rpcCall(s.URL, "EXPERIMENTAL_changes", params, &result); err != nil {
+		if strings.Contains(err.Error(), "UNKNOWN_BLOCK") || strings.Contains(err.Error(), "DB Not Found") {
+			// Skipped block
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result.Changes, nil
+}
+
+// changeRecord decodes a change of the contract state.  A deleted record
+// has no value.
+func (s *StateSync) changeRecord(change stateChange) (stateRecord, bool) {
+	if change.Change.AccountID != s.Contract {
+		return stateRecord{}, false
+	}
+	record, err := decodeStateEntry(s.Prefix, change.Change.Key, change.Change.Value)
+	if err != nil {
+		log.Debugf("skipping state change: %v", err)
+		return stateRecord{}, false
+	}
+	if change.Type == "data_deletion" {
+		record.value = nil
+	}
+	return record, true
+}
+
+// verify checks the owner signature of a signed value of the index if
+// required, and returns the value it carries.  Values that fail
+// verification in reject mode are empty.  Verified values are cached for as
+// long as the access keys of their account are.
+func (s *StateSync) verify(domain string, qtype uint16, key string, signed []byte) []byte {
+	if s.OwnerKeys == nil || len(signed) == 0 {
+		return signed
+	}
+	valueKey := verifiedKey{domain, qtype, key}
+	s.verifiedMu.Lock()
+	cached, exists := s.verified[valueKey]
+	s.verifiedMu.Unlock()
+	if exists && bytes.Equal(cached.signed, signed) && time.Since(cached.verified) < s.OwnerKeys.MaxAge {
+		return cached.value
+	}
+
+	value, err := s.OwnerKeys.Verify(strings.TrimSuffix(domain, "."), qtype, key, signed)
+	if err != nil {
+		value = nil
+	}
+	s.verifiedMu.Lock()
+	if s.verified == nil {
+		s.verified = make(map[verifiedKey]verifiedValue)
+	}
+	s.verified[valueKey] = verifiedValue{signed: signed, value: value, verified: time.Now()}
+	s.verifiedMu.Unlock()
+	return value
+}
+
+// index adds a record of the state to the accounts.  A record without a
+// value is removed.
+func index(accounts map[string]*indexedAccount, record stateRecord) {
+	account, exists := accounts[record.domain]
+	if !exists {
+		if len(record.value) == 0 {
+			return
+		}
+		account = &indexedAccount{rrSets: make(map[indexKey][]byte)}
+		accounts[record.domain] = account
+	}
+	if record.qtype == dns.TypeNone {
+		account.contentHash = record.value
+	} else if len(record.value) == 0 {
+		delete(account.rrSets, indexKey{record.qtype, record.key})
+	} else {
+		account.rrSets[indexKey{record.qtype, record.key}] = record.value
+	}
+	if len(account.contentHash) == 0 && len(account.rrSets) == 0 {
+		delete(accounts, record.domain)
+	}
+}
+
+// current returns true if the index is close enough to the chain to answer
+// from, or is restored from its snapshot and being brought up to date.  A
+// restored index that is further behind the chain than is caught up with
+// block by block is not answered from.  The caller holds the lock.
+func (s *StateSync) current() bool {
+	if s.height == 0 {
+		return false
+	}
+	if !s.restored.IsZero() {
+		if s.head > s.height+syncCatchUpBlocks {
+			return false
+		}
+		return time.Since(s.restored) < snapshotGrace
+	}
+	if s.head > s.height+s.MaxLag {
+		return false
+	}
+	return time.Since(s.synced) < syncStalePolls*s.Poll
+}
+
+// Lookup returns the value of a record kind for the account in domain from
+// the index, or false if the index is not current.  Record kinds are read
+// as the record sets of their type; accounts or record sets that are not in
+// the state have an empty value.
+func (s *StateSync) Lookup(kind string, domain string, qtype uint16, key string) ([]byte, bool) {
+	s.mu.RLock()
+	if !s.current() {
+		s.mu.RUnlock()
+		return nil, false
+	}
+	account, exists := s.accounts[domain]
+	if !exists {
+		s.mu.RUnlock()
+		return []byte{}, true
+	}
+	var signed []byte
+	if kind == kindContentHash {
+		qtype, key = dns.TypeNone, ""
+		signed = account.contentHash
+	} else {
+		signed = account.rrSets[indexKey{qtype, key}]
+	}
+	s.mu.RUnlock()
+	return s.verify(domain, qtype, key, signed), true
+}
+
+// RecordTypes returns the types of the record sets at the name of the
+// account in domain from the index, or false if the index is not current.
+func (s *StateSync) RecordTypes(domain string) ([]uint16, bool) {
+	s.mu.RLock()
+	if !s.current() {
+		s.mu.RUnlock()
+		return nil, false
+	}
+	signed := make(map[uint16][]byte)
+	if account, exists := s.accounts[domain]; exists {
+		for rrSetKey, value := range account.rrSets {
+			if rrSetKey.key == "" {
+				signed[rrSetKey.qtype] = value
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	types := make([]uint16, 0, len(signed))
+	for qtype, value := range signed {
+		if len(s.verify(domain, qtype, "", value)) > 0 {
+			types = append(types, qtype)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types, true
+}
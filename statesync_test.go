@@ -0,0 +1,189 @@
+package near
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stateNode is a NEAR node that serves the state of the DNS contract and its
+// changes per block.
+type stateNode struct {
+	head    uint64
+	state   map[string]string
+	changes map[uint64][]stateChange
+	loads   int
+}
+
+func (s *stateNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string `json:"method"`
+		Params struct {
+			BlockID uint64 `json:"block_id"`
+		} `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	var result interface{}
+	switch req.Method {
+	case "block":
+		result = map[string]interface{}{"header": map[string]uint64{"height": s.head}}
+	case "query":
+		s.loads++
+		values := make([]stateEntry, 0)
+		for key, value := range s.state {
+			values = append(values, stateEntry{
+				Key:   base64.StdEncoding.EncodeToString([]byte(key)),
+				Value: base64.StdEncoding.EncodeToString([]byte(value)),
+			})
+		}
+		result = map[string]interface{}{"values": values, "block_height": s.head}
+	case "EXPERIMENTAL_changes":
+		changes, exists := s.changes[req.Params.BlockID]
+		if !exists {
+			fmt.Fprint(w, `{"jsonrpc":"2.0","id":"coredns-near","error":{"name":"HANDLER_ERROR","cause":{"name":"UNKNOWN_BLOCK"},"code":-32000,"message":"Server error","data":"DB Not Found Error: BLOCK HEIGHT"}}`)
+			return
+		}
+		result = map[string]interface{}{"changes": changes}
+	}
+	encoded, _ := json.Marshal(result)
+	fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"coredns-near","result":%s}`, encoded)
+}
+
+// change creates a change of the contract state.
+func change(contract string, key string, value string) stateChange {
+	var c stateChange
+	c.Type = "data_update"
+	if value == "" {
+		c.Type = "data_deletion"
+	}
+	c.Change.AccountID = contract
+	c.Change.Key = base64.StdEncoding.EncodeToString([]byte(key))
+	c.Change.Value = base64.StdEncoding.EncodeToString([]byte(value))
+	return c
+}
+
+func TestStateSync(t *testing.T) {
+	node := &stateNode{
+		head: 100,
+		state: map[string]string{
+			"ralice:contenthash": "e3010170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f",
+			"ralice:A":           "@ 300 IN A 192.0.2.1",
+			"ralice:TXT:_dmarc":  "@ 300 IN TXT \"v=DMARC1\"",
+			"rbob:MX":            "@ 300 IN MX 10 mail.bob.near.",
+		},
+		changes: map[uint64][]stateChange{
+			101: {change("dns.near", "ralice:A", "@ 300 IN A 192.0.2.2")},
+			// 102 is skipped
+			103: {change("dns.near", "rbob:MX", ""), change("other.near", "rcarol:A", "@ 300 IN A 192.0.2.3")},
+		},
+	}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	s := NewStateSync(server.URL, "dns.near", []byte("r"))
+	n := NEAR{NEARDNS: "dns.near", StateSync: s}
+
+	if _, ok := s.Lookup(kindA, "alice.near.", dns.TypeA, ""); ok {
+		t.Errorf("Lookup before the state is read succeeded")
+	}
+
+	s.sync()
+	value, err := n.view(kindA, "alice.near.", dns.TypeA, "")
+	if err != nil || string(value) != "@ 300 IN A 192.0.2.1" {
+		t.Errorf("A of alice.near => %q, %v", value, err)
+	}
+	value, err = n.view(kindRecords, "alice.near.", dns.TypeTXT, "_dmarc")
+	if err != nil || string(value) != "@ 300 IN TXT \"v=DMARC1\"" {
+		t.Errorf("TXT of _dmarc.alice.near => %q, %v", value, err)
+	}
+	value, err = n.view(kindContentHash, "alice.near.", dns.TypeNone, "")
+	if err != nil || len(value) == 0 {
+		t.Errorf("content hash of alice.near => %q, %v", value, err)
+	}
+	value, err = n.view(kindA, "carol.near.", dns.TypeA, "")
+	if err != nil || len(value) != 0 {
+		t.Errorf("A of carol.near => %q, %v (expected none)", value, err)
+	}
+	types, err := n.obtainRecordTypes("bob.near.", "bob.near.")
+	if err != nil || len(types) != 1 || types[0] != dns.TypeMX {
+		t.Errorf("record types of bob.near => %v, %v (expected [MX])", types, err)
+	}
+
+	node.head = 103
+	s.sync()
+	if node.loads != 1 {
+		t.Errorf("state read %d times (expected once)", node.loads)
+	}
+	value, _ = n.view(kindA, "alice.near.", dns.TypeA, "")
+	if string(value) != "@ 300 IN A 192.0.2.2" {
+		t.Errorf("A of alice.near after changes => %q", value)
+	}
+	types, _ = n.obtainRecordTypes("bob.near.", "bob.near.")
+	if len(types) != 0 {
+		t.Errorf("record types of bob.near after deletion => %v (expected none)", types)
+	}
+	if value, _ := s.Lookup(kindA, "carol.near.", dns.TypeA, ""); len(value) != 0 {
+		t.Errorf("change of another contract was indexed")
+	}
+
+	// Falling behind more than the lag falls back to the contract
+	s.mu.Lock()
+	s.head = 103 + s.MaxLag + 1
+	s.mu.Unlock()
+	if _, ok := s.Lookup(kindA, "alice.near.", dns.TypeA, ""); ok {
+		t.Errorf("Lookup of a lagging index succeeded")
+	}
+}
+
+func TestStateSyncOwnerKeys(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	rrSet := []byte("@ 300 IN A 192.0.2.1")
+	signature := ed25519.Sign(private, ownerSignedMessage("alice.near", dns.TypeA, "", rrSet))
+	signed, _ := json.Marshal(signedRRSet{
+		RRSet:     base64.StdEncoding.EncodeToString(rrSet),
+		Signature: "ed25519:" + encodeBase58(signature),
+	})
+
+	var revoked atomic.Bool
+	keyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := fmt.Sprintf(`{"public_key":"ed25519:%s","access_key":{"nonce":1,"permission":"FullAccess"}}`, encodeBase58(public))
+		if revoked.Load() {
+			keys = ""
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"coredns-near","result":{"block_height":100,"keys":[%s]}}`, keys)
+	}))
+	defer keyServer.Close()
+
+	s := &StateSync{Poll: defaultSyncPoll, MaxLag: defaultSyncLag, accounts: make(map[string]*indexedAccount), height: 1, head: 1, synced: time.Now()}
+	s.OwnerKeys = NewOwnerKeys(keyServer.URL, true, time.Hour)
+	index(s.accounts, stateRecord{domain: "alice.near.", qtype: dns.TypeA, value: signed})
+
+	if value, ok := s.Lookup(kindA, "alice.near.", dns.TypeA, ""); !ok || string(value) != string(rrSet) {
+		t.Errorf("A of alice.near => %q, %v", value, ok)
+	}
+	if types, _ := s.RecordTypes("alice.near."); len(types) != 1 {
+		t.Errorf("record types of alice.near => %v (expected [A])", types)
+	}
+
+	// A revoked key is noticed once the cached keys expire
+	revoked.Store(true)
+	if value, _ := s.Lookup(kindA, "alice.near.", dns.TypeA, ""); string(value) != string(rrSet) {
+		t.Errorf("A of alice.near with cached keys => %q", value)
+	}
+	s.OwnerKeys.MaxAge = time.Nanosecond
+	if value, _ := s.Lookup(kindA, "alice.near.", dns.TypeA, ""); len(value) != 0 {
+		t.Errorf("A of alice.near signed with a revoked key => %q (expected none)", value)
+	}
+	if types, _ := s.RecordTypes("alice.near."); len(types) != 0 {
+		t.Errorf("record types of alice.near signed with a revoked key => %v (expected none)", types)
+	}
+}
@@ -0,0 +1,91 @@
+package near
+
+import (
+	"github.com/miekg/dns"
+)
+
+// defaultTTL is the TTL of synthesized records if no default is configured.
+const defaultTTL = 3600
+
+// TTLBounds are a default, minimum and maximum TTL.  Zero values are unset.
+type TTLBounds struct {
+	Default uint32
+	Min     uint32
+	Max     uint32
+}
+
+// TTLPolicy sets the TTLs of served records.  Bounds for a record type
+// override those for all types, and bounds for records synthesized from
+// the IPFS gateways override both.
+type TTLPolicy struct {
+	All     TTLBounds
+	Types   map[uint16]TTLBounds
+	Gateway TTLBounds
+}
+
+// merge returns the bounds with the set values of other taking precedence.
+func (b TTLBounds) merge(other TTLBounds) TTLBounds {
+	if other.Default != 0 {
+		b.Default = other.Default
+	}
+	if other.Min != 0 {
+		b.Min = other.Min
+	}
+	if other.Max != 0 {
+		b.Max = other.Max
+	}
+	return b
+}
+
+// clamp returns ttl limited to the bounds.
+func (b TTLBounds) clamp(ttl uint32) uint32 {
+	if b.Min != 0 && ttl < b.Min {
+		ttl = b.Min
+	}
+	if b.Max != 0 && ttl > b.Max {
+		ttl = b.Max
+	}
+	return ttl
+}
+
+// ttlBounds returns the TTL bounds for records of a type, either read from
+// the contract or synthesized from the IPFS gateways.
+func (n NEAR) ttlBounds(qtype uint16, gateway bool) TTLBounds {
+	if n.TTL == nil {
+		return TTLBounds{}
+	}
+	bounds := n.TTL.All.merge(n.TTL.Types[qtype])
+	if gateway {
+		bounds = bounds.merge(n.TTL.Gateway)
+	}
+	return bounds
+}
+
+// synthesizedTTL returns the TTL of a synthesized record.  Records
+// synthesized from the IPFS gateways do not outlive the resolution of
+// gateway hostnames, so that clients see address changes in time.
+func (n NEAR) synthesizedTTL(qtype uint16, gateway bool) uint32 {
+	bounds := n.ttlBounds(qtype, gateway)
+	ttl := bounds.Default
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	ttl = bounds.clamp(ttl)
+	if gateway && n.GatewayResolver != nil {
+		if refresh := uint32(n.GatewayResolver.Refresh.Seconds()); refresh > 0 && ttl > refresh {
+			ttl = refresh
+		}
+	}
+	return ttl
+}
+
+// contractRRSet decodes a record set read from the contract and clamps the
+// TTLs of its records into the configured bounds.
+func (n NEAR) contractRRSet(domain string, rrSet []byte, name string, qtype uint16) []dns.RR {
+	results := decodeRRSet(domain, rrSet, name, qtype)
+	bounds := n.ttlBounds(qtype, false)
+	for _, result := range results {
+		result.Header().Ttl = bounds.clamp(result.Header().Ttl)
+	}
+	return results
+}
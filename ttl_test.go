@@ -0,0 +1,62 @@
+package near
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSynthesizedTTL(t *testing.T) {
+	policy := &TTLPolicy{
+		All:     TTLBounds{Default: 1800, Min: 60, Max: 86400},
+		Types:   map[uint16]TTLBounds{dns.TypeTXT: {Max: 600}},
+		Gateway: TTLBounds{Default: 7200},
+	}
+	tests := []struct {
+		policy   *TTLPolicy
+		resolver *GatewayResolver
+		qtype    uint16
+		gateway  bool
+		ttl      uint32
+	}{
+		{nil, nil, dns.TypeA, true, 3600},
+		{policy, nil, dns.TypeNS, false, 1800},
+		{policy, nil, dns.TypeTXT, false, 600},
+		{policy, nil, dns.TypeA, true, 7200},
+		{policy, &GatewayResolver{Refresh: 5 * time.Minute}, dns.TypeA, true, 300},
+		{policy, &GatewayResolver{Refresh: 5 * time.Minute}, dns.TypeNS, false, 1800},
+	}
+	for i, tt := range tests {
+		n := NEAR{TTL: tt.policy, GatewayResolver: tt.resolver}
+		if ttl := n.synthesizedTTL(tt.qtype, tt.gateway); ttl != tt.ttl {
+			t.Errorf("Test %d: expected TTL %d, got %d", i, tt.ttl, ttl)
+		}
+	}
+}
+
+func TestContractRRSetTTL(t *testing.T) {
+	n := NEAR{TTL: &TTLPolicy{
+		All:   TTLBounds{Min: 60, Max: 86400},
+		Types: map[uint16]TTLBounds{dns.TypeTXT: {Max: 600}},
+	}}
+	tests := []struct {
+		rrSet string
+		qtype uint16
+		ttl   uint32
+	}{
+		{"@ 5 IN A 192.0.2.1", dns.TypeA, 60},
+		{"@ 300 IN A 192.0.2.1", dns.TypeA, 300},
+		{"@ 604800 IN A 192.0.2.1", dns.TypeA, 86400},
+		{"@ 3600 IN TXT \"hello\"", dns.TypeTXT, 600},
+	}
+	for i, tt := range tests {
+		rrs := n.contractRRSet("alice.near.", []byte(tt.rrSet), "alice.near.", tt.qtype)
+		if len(rrs) != 1 {
+			t.Fatalf("Test %d: expected 1 record, got %d", i, len(rrs))
+		}
+		if rrs[0].Header().Ttl != tt.ttl {
+			t.Errorf("Test %d: expected TTL %d, got %d", i, tt.ttl, rrs[0].Header().Ttl)
+		}
+	}
+}
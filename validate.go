@@ -0,0 +1,131 @@
+package near
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxRecords is the maximum number of records served from a single
+	// record set in the contract.
+	maxRecords = 64
+	// maxRRSetSize is the maximum size in bytes of a record set in the
+	// contract.
+	maxRRSetSize = 16384
+)
+
+// Reasons for rejecting records read from the contract.
+const (
+	reasonMalformed = "malformed"
+	reasonClass     = "class"
+	reasonType      = "type"
+	reasonOwner     = "owner"
+	reasonCount     = "count"
+	reasonSize      = "size"
+	reasonEncoding  = "encoding"
+	reasonFormat    = "format"
+	reasonSignature = "signature"
+)
+
+// decodeRRSet decodes a record set read from the contract for an account
+// and validates it for the query.  Records must be of class IN and of the
+// query type.  The owner of wire format records is rewritten to the query
+// name, as the contract is keyed by name already; text and JSON records
+// name their owner relative to the account and must be owned by the query
+// name.  Decoding stops at the first malformed record.  Rejected records
+// are counted per account.
+func decodeRRSet(domain string, rrSet []byte, name string, qtype uint16) []dns.RR {
+	account := strings.TrimSuffix(domain, ".near.")
+	results := make([]dns.RR, 0)
+	if len(rrSet) > maxRRSetSize {
+		invalidRecordsCount.WithLabelValues(account, reasonSize).Inc()
+		return results
+	}
+
+	wire := recordFormat(rrSet) == formatWire
+	rrs, err := parseRRSet(rrSet, domain)
+	if err != nil {
+		invalidRecordsCount.WithLabelValues(account, reasonMalformed).Inc()
+	}
+	for _, result := range rrs {
+		hdr := result.Header()
+		if hdr.Class != dns.ClassINET {
+			invalidRecordsCount.WithLabelValues(account, reasonClass).Inc()
+			continue
+		}
+		if hdr.Rrtype != qtype {
+			invalidRecordsCount.WithLabelValues(account, reasonType).Inc()
+			continue
+		}
+		if wire {
+			hdr.Name = name
+		}
+		hdr.Name = dns.CanonicalName(hdr.Name)
+		if hdr.Name != name {
+			invalidRecordsCount.WithLabelValues(account, reasonOwner).Inc()
+			continue
+		}
+		if err := checkRecord(result); err != nil {
+			invalidRecordsCount.WithLabelValues(account, reasonFormat).Inc()
+			continue
+		}
+		if len(results) == maxRecords {
+			invalidRecordsCount.WithLabelValues(account, reasonCount).Inc()
+			break
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// digestLengths are the lengths of DS digests by digest type.
+var digestLengths = map[uint8]int{
+	dns.SHA1:   sha1.Size,
+	dns.SHA256: sha256.Size,
+	dns.SHA384: sha512.Size384,
+}
+
+// checkRecord checks the content of records whose format the DNS library
+// does not enforce.  DS records must use a known algorithm and digest type
+// with a digest of the right length; DNSKEY records must be zone keys of
+// protocol 3 with a known algorithm and a public key.
+func checkRecord(rr dns.RR) error {
+	switch rr := rr.(type) {
+	case *dns.DS:
+		if _, exists := dns.AlgorithmToString[rr.Algorithm]; !exists {
+			return fmt.Errorf("unknown DS algorithm %d", rr.Algorithm)
+		}
+		length, exists := digestLengths[rr.DigestType]
+		if !exists {
+			return fmt.Errorf("unknown DS digest type %d", rr.DigestType)
+		}
+		digest, err := hex.DecodeString(rr.Digest)
+		if err != nil || len(digest) != length {
+			return fmt.Errorf("invalid DS digest %q", rr.Digest)
+		}
+	case *dns.DNSKEY:
+		if rr.Protocol != 3 {
+			return fmt.Errorf("invalid DNSKEY protocol %d", rr.Protocol)
+		}
+		if rr.Flags&dns.ZONE == 0 {
+			return errors.New("DNSKEY is not a zone key")
+		}
+		if _, exists := dns.AlgorithmToString[rr.Algorithm]; !exists {
+			return fmt.Errorf("unknown DNSKEY algorithm %d", rr.Algorithm)
+		}
+		key, err := base64.StdEncoding.DecodeString(rr.PublicKey)
+		if err != nil || len(key) == 0 {
+			return errors.New("invalid DNSKEY public key")
+		}
+	}
+	return nil
+}
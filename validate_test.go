@@ -0,0 +1,112 @@
+package near
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// packRRs packs records into wire format as stored in the contract.
+func packRRs(t *testing.T, rrs ...string) []byte {
+	buf := make([]byte, 0)
+	for _, rr := range rrs {
+		packed := make([]byte, 512)
+		off, err := dns.PackRR(newRR(rr), packed, 0, nil, false)
+		if err != nil {
+			t.Fatalf("Failed to pack %s: %v", rr, err)
+		}
+		buf = append(buf, packed[:off]...)
+	}
+	return buf
+}
+
+func TestDecodeRRSet(t *testing.T) {
+	rrSet := packRRs(t,
+		"alice.near. 3600 IN MX 10 mail.alice.near.",
+		"alice.near. 3600 IN CAA 0 issue \"letsencrypt.org\"",
+		"other.near. 3600 IN MX 20 backup.example.org.",
+		"alice.near. 3600 CH MX 30 chaos.example.org.",
+	)
+	many := make([]string, maxRecords+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("alice.near. 3600 IN A 192.0.2.%d", i)
+	}
+
+	tests := []struct {
+		qtype   uint16
+		rrSet   []byte
+		records int
+	}{
+		{dns.TypeMX, rrSet, 2},
+		{dns.TypeCAA, rrSet, 1},
+		{dns.TypeSRV, rrSet, 0},
+		{dns.TypeMX, rrSet[:len(rrSet)-3], 2},
+		{dns.TypeMX, []byte{0x00, 0x00, 0x0f}, 0},
+		{dns.TypeMX, []byte{}, 0},
+		{dns.TypeA, packRRs(t, many...), maxRecords},
+		{dns.TypeA, make([]byte, maxRRSetSize+1), 0},
+	}
+	for i, tt := range tests {
+		rrs := decodeRRSet("alice.near.", tt.rrSet, "alice.near.", tt.qtype)
+		if len(rrs) != tt.records {
+			t.Errorf("Test %d returned %d records (expected %d)", i, len(rrs), tt.records)
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != tt.qtype || rr.Header().Class != dns.ClassINET || rr.Header().Name != "alice.near." {
+				t.Errorf("Test %d returned unexpected record %v", i, rr)
+			}
+		}
+	}
+}
+
+func TestDecodeRRSetOwner(t *testing.T) {
+	tests := []struct {
+		rrSet   string
+		name    string
+		records int
+	}{
+		{`[{"name":"mail","type":"MX","value":"10 mx.example.org."}]`, "mail.alice.near.", 1},
+		{`[{"name":"mail","type":"MX","value":"10 mx.example.org."}]`, "alice.near.", 0},
+		{`[{"type":"MX","value":"10 mx.example.org."}]`, "alice.near.", 1},
+		{"_dmarc 300 IN MX 10 mx.example.org.", "_dmarc.alice.near.", 1},
+		{"@ 300 IN MX 10 mx.example.org.", "_dmarc.alice.near.", 0},
+		{"Mail.Alice.Near. 300 IN MX 10 mx.example.org.", "mail.alice.near.", 1},
+		{"bob.near. 300 IN MX 10 mx.example.org.", "alice.near.", 0},
+		{string(packRRs(t, "bob.near. 300 IN MX 10 mx.example.org.")), "alice.near.", 1},
+		{string(packRRs(t, ". 300 IN MX 10 mx.example.org.")), "_dmarc.alice.near.", 1},
+	}
+	for i, tt := range tests {
+		rrs := decodeRRSet("alice.near.", []byte(tt.rrSet), tt.name, dns.TypeMX)
+		if len(rrs) != tt.records {
+			t.Errorf("Test %d: %s at %s returned %v (expected %d records)", i, tt.rrSet, tt.name, rrs, tt.records)
+		}
+		for _, rr := range rrs {
+			if rr.Header().Name != tt.name {
+				t.Errorf("Test %d returned %v (expected owner %s)", i, rr, tt.name)
+			}
+		}
+	}
+}
+
+func TestCheckRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		valid  bool
+	}{
+		{"alice.near. 3600 IN DS 12345 13 2 2bb183af5f22588179a53b0a98631fad1a292118a0f7c5fbd7ab3e2b2a3e5f8e", true},
+		{"alice.near. 3600 IN DS 12345 13 1 2bb183af5f22588179a53b0a98631fad1a292118", true},
+		{"alice.near. 3600 IN DS 12345 13 2 2bb183af5f22588179a53b0a98631fad1a292118", false},
+		{"alice.near. 3600 IN DS 12345 13 9 2bb183af5f22588179a53b0a98631fad1a292118", false},
+		{"alice.near. 3600 IN DS 12345 200 2 2bb183af5f22588179a53b0a98631fad1a292118a0f7c5fbd7ab3e2b2a3e5f8e", false},
+		{"alice.near. 3600 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==", true},
+		{"alice.near. 3600 IN DNSKEY 257 2 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==", false},
+		{"alice.near. 3600 IN DNSKEY 0 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==", false},
+		{"alice.near. 3600 IN MX 10 mail.alice.near.", true},
+	}
+	for i, tt := range tests {
+		if err := checkRecord(newRR(tt.record)); (err == nil) != tt.valid {
+			t.Errorf("Test %d: %v => %v (expected valid %v)", i, tt.record, err, tt.valid)
+		}
+	}
+}
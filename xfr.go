@@ -0,0 +1,386 @@
+package near
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/labstack/gommon/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// minSnapshotAge is how long a zone snapshot is reused before the
+	// contract state is read again.
+	minSnapshotAge = 10 * time.Second
+	// maxJournalEntries is the number of zone differences kept for IXFR.
+	maxJournalEntries = 128
+)
+
+// ZoneTransfer builds the zone from the contract state for transfers to
+// secondary nameservers, from the record sets stored below Prefix (see
+// decodeStateEntry).  The serial of the zone is the block height of
+// the state, and the differences between successive snapshots are kept in a
+// journal for incremental transfers.  The state is read again every Poll
+// interval while the zone is watched, and the Notifier, if set, notifies the
+// secondaries of changes.
+type ZoneTransfer struct {
+	URL      string
+	Prefix   []byte
+	Poll     time.Duration
+	Notifier *Notifier
+
+	// reading serializes reads of the state; mu guards the snapshot and
+	// the journal.
+	reading  sync.Mutex
+	mu       sync.Mutex
+	snapshot *zoneSnapshot
+	journal  []journalEntry
+	stop     chan struct{}
+}
+
+// zoneSnapshot is the zone at a block height.
+type zoneSnapshot struct {
+	serial  uint32
+	soa     *dns.SOA
+	records []dns.RR
+	taken   time.Time
+}
+
+// journalEntry holds the differences between two serials of the zone.
+type journalEntry struct {
+	from    *dns.SOA
+	to      *dns.SOA
+	removed []dns.RR
+	added   []dns.RR
+}
+
+// NewZoneTransfer creates a zone transfer that reads the state of the
+// contract through the NEAR node at url.
+func NewZoneTransfer(url string, prefix []byte) *ZoneTransfer {
+	return &ZoneTransfer{URL: url, Prefix: prefix, Poll: defaultZonePoll}
+}
+
+// Stop stops watching the zone.
+func (z *ZoneTransfer) Stop() error {
+	if z.stop != nil {
+		close(z.stop)
+		z.stop = nil
+	}
+	return nil
+}
+
+// serial returns the serial of the latest snapshot of the zone, if there is
+// one.
+func (z *ZoneTransfer) serial() (uint32, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.snapshot == nil {
+		return 0, false
+	}
+	return z.snapshot.serial, true
+}
+
+// Transfer implements the transfer.Transferer interface.  An IXFR from a
+// serial in the journal is answered with the differences since; others fall
+// back to a full transfer.
+func (n NEAR) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	if n.ZoneTransfer == nil || !strings.EqualFold(dns.Fqdn(zone), n.zone()) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+	snapshot, err := n.currentZone(false)
+	if err != nil {
+		log.Errorf("failed to read zone %s for transfer: %v", n.zone(), err)
+		return nil, err
+	}
+
+	ch := make(chan []dns.RR)
+	go func() {
+		defer close(ch)
+		if serial != 0 && serial >= snapshot.serial {
+			// Up to date
+			ch <- []dns.RR{snapshot.soa}
+			return
+		}
+		if serial != 0 {
+			if entries := n.ZoneTransfer.journalSince(serial, snapshot.serial); entries != nil {
+				ch <- []dns.RR{snapshot.soa}
+				for _, entry := range entries {
+					ch <- append(append([]dns.RR{entry.from}, entry.removed...), entry.to)
+					if len(entry.added) > 0 {
+						ch <- entry.added
+					}
+				}
+				ch <- []dns.RR{snapshot.soa}
+				return
+			}
+		}
+		ch <- []dns.RR{snapshot.soa}
+		if len(snapshot.records) > 0 {
+			ch <- snapshot.records
+		}
+		ch <- []dns.RR{snapshot.soa}
+	}()
+	return ch, nil
+}
+
+// currentZone returns the zone, reading the contract state unless a
+// recent snapshot exists or force is set.  A snapshot at a new serial adds
+// its differences to the journal.
+func (n NEAR) currentZone(force bool) (*zoneSnapshot, error) {
+	z := n.ZoneTransfer
+	z.reading.Lock()
+	defer z.reading.Unlock()
+	z.mu.Lock()
+	if !force && z.snapshot != nil && time.Since(z.snapshot.taken) < minSnapshotAge {
+		defer z.mu.Unlock()
+		return z.snapshot, nil
+	}
+	z.mu.Unlock()
+
+	entries, height, err := readContractState(z.URL, n.NEARDNS, z.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	if n.BlockHeight != nil {
+		n.BlockHeight.Observe(height)
+	}
+	snapshot := n.buildZone(entries, uint32(height))
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.snapshot != nil && snapshot.serial > z.snapshot.serial {
+		removed, added := diffRecords(z.snapshot.records, snapshot.records)
+		if len(removed) > 0 || len(added) > 0 {
+			z.journal = append(z.journal, journalEntry{from: z.snapshot.soa, to: snapshot.soa, removed: removed, added: added})
+			if len(z.journal) > maxJournalEntries {
+				z.journal = z.journal[len(z.journal)-maxJournalEntries:]
+			}
+		} else {
+			// Nothing changed; keep the serial so that secondaries stay current
+			snapshot.serial = z.snapshot.serial
+			snapshot.soa = z.snapshot.soa
+		}
+	}
+	if z.snapshot == nil || snapshot.serial >= z.snapshot.serial {
+		z.snapshot = snapshot
+	}
+	return z.snapshot, nil
+}
+
+// journalSince returns the journal entries that lead from serial to current,
+// or nil if the journal does not reach back to serial.
+func (z *ZoneTransfer) journalSince(serial uint32, current uint32) []journalEntry {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for i, entry := range z.journal {
+		if entry.from.Serial == serial {
+			entries := z.journal[i:]
+			if entries[len(entries)-1].to.Serial != current {
+				return nil
+			}
+			return entries
+		}
+	}
+	return nil
+}
+
+// buildZone builds the zone from the entries of the contract state at a
+// block height.  The apex records come from the configuration as they are
+// answered, and the records synthesized from content hashes are those
+// answered to clients without a gateway pool region.
+func (n NEAR) buildZone(entries []stateEntry, serial uint32) *zoneSnapshot {
+	prefix := n.ZoneTransfer.Prefix
+	apexRrs := make([]dns.RR, 0)
+	for _, qtype := range []uint16{dns.TypeNS, dns.TypeA, dns.TypeAAAA, dns.TypeTXT} {
+		rrs, _ := n.handleApex(zoneApex, qtype)
+		apexRrs = append(apexRrs, rrs...)
+	}
+	nameservers := make([]string, 0, len(n.NameServerAddresses))
+	for nameserver := range n.NameServerAddresses {
+		if dns.IsSubDomain(n.zone(), nameserver) || dns.IsSubDomain(zoneApex, nameserver) {
+			nameservers = append(nameservers, nameserver)
+		}
+	}
+	sort.Strings(nameservers)
+	for _, nameserver := range nameservers {
+		apexRrs = append(apexRrs, n.handleGlue(nameserver, dns.TypeA)...)
+		apexRrs = append(apexRrs, n.handleGlue(nameserver, dns.TypeAAAA)...)
+	}
+
+	// The state is indexed so that the records synthesized from content
+	// hashes are built as they are answered, without reading the contract
+	state := &StateSync{Poll: defaultSyncPoll, accounts: make(map[string]*indexedAccount), height: 1, head: 1, synced: time.Now()}
+	records := make([]stateRecord, 0, len(entries))
+	for _, entry := range entries {
+		record, err := decodeStateEntry(prefix, entry.Key, entry.Value)
+		if err != nil {
+			log.Debugf("skipping state entry: %v", err)
+			continue
+		}
+		if record.qtype == dns.TypeSOA || record.qtype == dns.TypeDNSKEY {
+			continue
+		}
+		if n.OwnerKeys != nil && len(record.value) > 0 {
+			if record.value, err = n.OwnerKeys.Verify(strings.TrimSuffix(record.domain, "."), record.qtype, record.key, record.value); err != nil {
+				continue
+			}
+		}
+		index(state.accounts, record)
+		records = append(records, record)
+	}
+	// At and below a zone cut only the delegation is ours: the NS and DS
+	// records at the cut and the glue of its nameservers
+	glue := make(map[string]map[string]bool)
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		if record.qtype == dns.TypeNone {
+			continue
+		}
+		cut := zoneCut(state.accounts, record.domain)
+		if cut == "" {
+			rrs = append(rrs, n.contractRRSet(record.domain, record.value, record.name(), record.qtype)...)
+			continue
+		}
+		switch {
+		case record.name() == cut && (record.qtype == dns.TypeNS || record.qtype == dns.TypeDS):
+		case record.qtype == dns.TypeA || record.qtype == dns.TypeAAAA:
+			if _, exists := glue[cut]; !exists {
+				glue[cut] = n.glueNames(cut, state.accounts[cut].rrSets[indexKey{dns.TypeNS, ""}])
+			}
+			if !glue[cut][strings.ToLower(record.name())] {
+				continue
+			}
+		default:
+			continue
+		}
+		rrs = append(rrs, n.contractRRSet(record.domain, record.value, record.name(), record.qtype)...)
+	}
+	synthesizer := n
+	synthesizer.StateSync = state
+	synthesizer.clientIP = nil
+	synthesizer.gatewaySelected = nil
+	for domain, account := range state.accounts {
+		if bytes.Compare(account.contentHash, emptyContentHash) <= 0 {
+			continue
+		}
+		if zoneCut(state.accounts, domain) != "" {
+			// Names at and below a zone cut are not ours
+			continue
+		}
+		rrs = append(rrs, synthesizer.gatewayRecords(domain)...)
+	}
+	rrs = uniqueRecords(rrs)
+	sortRecords(rrs)
+
+	if serial == 0 {
+		serial = 1
+	}
+	soaRrs := n.soaRecord(zoneApex, serial)
+	var soa *dns.SOA
+	if len(soaRrs) > 0 {
+		soa = soaRrs[0].(*dns.SOA)
+	} else {
+		soa = &dns.SOA{Hdr: dns.RR_Header{Name: zoneApex, Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Ns: zoneApex, Mbox: "hostmaster." + zoneApex, Serial: serial}
+	}
+
+	zoneRrs := append(apexRrs, rrs...)
+	n.externalNames(zoneRrs)
+	n.externalNames([]dns.RR{soa})
+	return &zoneSnapshot{serial: serial, soa: soa, records: zoneRrs, taken: time.Now()}
+}
+
+// zoneCut returns the highest account at or above domain that is delegated
+// by publishing NS records at its own name, if any.
+func zoneCut(accounts map[string]*indexedAccount, domain string) string {
+	for _, account := range parentAccounts(domain) {
+		if indexed, exists := accounts[account]; exists {
+			if _, delegated := indexed.rrSets[indexKey{dns.TypeNS, ""}]; delegated {
+				return account
+			}
+		}
+	}
+	return ""
+}
+
+// glueNames returns the nameservers of a delegation that are at or below
+// its zone cut, and so need glue.
+func (n NEAR) glueNames(cut string, rrSet []byte) map[string]bool {
+	names := make(map[string]bool)
+	for _, rr := range n.contractRRSet(cut, rrSet, cut, dns.TypeNS) {
+		if ns, ok := rr.(*dns.NS); ok && dns.IsSubDomain(cut, ns.Ns) {
+			names[strings.ToLower(ns.Ns)] = true
+		}
+	}
+	return names
+}
+
+// gatewayRecords returns the records of an account as they are answered
+// from its content hash: a gateway CNAME if there is one, otherwise the
+// TXT, address and service binding records.
+func (n NEAR) gatewayRecords(domain string) []dns.RR {
+	cnameRrs, _ := n.Query(domain, domain, dns.TypeCNAME, false)
+	if len(cnameRrs) > 0 {
+		return cnameRrs
+	}
+	results := make([]dns.RR, 0)
+	for _, qtype := range []uint16{dns.TypeTXT, dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB} {
+		rrs, _ := n.Query(domain, domain, qtype, false)
+		results = append(results, rrs...)
+	}
+	return results
+}
+
+// uniqueRecords returns the records without duplicates.
+func uniqueRecords(rrs []dns.RR) []dns.RR {
+	seen := make(map[string]bool, len(rrs))
+	results := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if !seen[rr.String()] {
+			seen[rr.String()] = true
+			results = append(results, rr)
+		}
+	}
+	return results
+}
+
+// sortRecords sorts records by owner name and type, so that the records of
+// a name are transferred together.
+func sortRecords(rrs []dns.RR) {
+	sort.SliceStable(rrs, func(i, j int) bool {
+		a, b := rrs[i].Header(), rrs[j].Header()
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Rrtype < b.Rrtype
+	})
+}
+
+// diffRecords returns the records of old that are not in current and those of
+// current that are not in old.
+func diffRecords(old []dns.RR, current []dns.RR) ([]dns.RR, []dns.RR) {
+	oldSet := make(map[string]bool, len(old))
+	for _, rr := range old {
+		oldSet[rr.String()] = true
+	}
+	newSet := make(map[string]bool, len(current))
+	for _, rr := range current {
+		newSet[rr.String()] = true
+	}
+	removed := make([]dns.RR, 0)
+	for _, rr := range old {
+		if !newSet[rr.String()] {
+			removed = append(removed, rr)
+		}
+	}
+	added := make([]dns.RR, 0)
+	for _, rr := range current {
+		if !oldSet[rr.String()] {
+			added = append(added, rr)
+		}
+	}
+	return removed, added
+}
@@ -0,0 +1,180 @@
+package near
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// borshString encodes a Borsh string or byte vector.
+func borshString(value string) []byte {
+	encoded := make([]byte, 4, 4+len(value))
+	binary.LittleEndian.PutUint32(encoded, uint32(len(value)))
+	return append(encoded, value...)
+}
+
+// transferRecords collects the records of a transfer.
+func transferRecords(t *testing.T, n NEAR, zone string, serial uint32) []string {
+	ch, err := n.Transfer(zone, serial)
+	if err != nil {
+		t.Fatalf("Transfer(%s, %d) failed: %v", zone, serial, err)
+	}
+	records := make([]string, 0)
+	for rrs := range ch {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				records = append(records, fmt.Sprintf("SOA %d", soa.Serial))
+				continue
+			}
+			fields := strings.Fields(rr.String())
+			records = append(records, strings.Join(append([]string{fields[0], fields[3]}, fields[4:]...), " "))
+		}
+	}
+	return records
+}
+
+// contractStateServer serves the entries of state whose keys start with r as
+// the contract state at height.
+func contractStateServer(state map[string]string, height *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := make([]map[string]string, 0)
+		for key, value := range state {
+			if key[0] != 'r' {
+				continue
+			}
+			values = append(values, map[string]string{
+				"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+				"value": base64.StdEncoding.EncodeToString([]byte(value)),
+			})
+		}
+		result, _ := json.Marshal(map[string]interface{}{"values": values, "block_height": *height})
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"coredns-near","result":%s}`, result)
+	}))
+}
+
+func TestTransfer(t *testing.T) {
+	height := 1000
+	state := map[string]string{
+		"r" + string(borshString("alice:A")):          "@ 300 IN A 192.0.2.1",
+		"r" + string(borshString("bob.near:MX")):      "@ 300 IN MX 10 mail.bob.near.",
+		"r" + string(borshString("bob:16:_dmarc")):    "_dmarc 300 IN TXT \"v=DMARC1\"",
+		"r" + string(borshString("Invalid!:A")):       "@ 300 IN A 192.0.2.9",
+		"x" + string(borshString("carol:A")):          "@ 300 IN A 192.0.2.3",
+		"r" + string(borshString("carol:SOA")):        "@ 300 IN SOA a. b. 1 2 3 4 5",
+		"r" + string(borshString("carol:A:www")):      string(borshString("www 300 IN A 192.0.2.4")),
+		"r" + string(borshString("alice:AAAA:ipv6")):  "ipv6 300 IN AAAA 2001:db8::1",
+		"r" + string(borshString("dave:contenthash")): testContentHash,
+	}
+	server := contractStateServer(state, &height)
+	defer server.Close()
+
+	n := NEAR{
+		NEARDNS:             "dns.near",
+		NEARLinkNameServers: []string{"ns1.near.link."},
+		NameServerAddresses: map[string][]string{"ns1.near.link.": {"192.0.2.53"}},
+		IPFSGatewayAs:       []string{"192.0.2.80"},
+		Zone:                "near.link.",
+		ZoneTransfer:        NewZoneTransfer(server.URL, []byte("r")),
+	}
+
+	if _, err := n.Transfer("example.org.", 0); err != transfer.ErrNotAuthoritative {
+		t.Errorf("Transfer of another zone returned %v (expected ErrNotAuthoritative)", err)
+	}
+
+	expected := []string{
+		"SOA 1000",
+		"near.link. NS ns1.near.link.",
+		"ns1.near.link. A 192.0.2.53",
+		"_dmarc.bob.near.link. TXT \"v=DMARC1\"",
+		"alice.near.link. A 192.0.2.1",
+		"bob.near.link. MX 10 mail.bob.near.link.",
+		"dave.near.link. A 192.0.2.80",
+		"dave.near.link. TXT \"contenthash=0x" + testContentHash + "\"",
+		"ipv6.alice.near.link. AAAA 2001:db8::1",
+		"www.carol.near.link. A 192.0.2.4",
+		"SOA 1000",
+	}
+	checkRecords(t, "AXFR", transferRecords(t, n, "near.link.", 0), expected)
+	checkRecords(t, "up to date IXFR", transferRecords(t, n, "near.link.", 1000), []string{"SOA 1000"})
+
+	// Change the state at a later block
+	height = 1005
+	delete(state, "r"+string(borshString("alice:A")))
+	state["r"+string(borshString("alice:A"))] = "@ 300 IN A 192.0.2.2"
+	n.ZoneTransfer.snapshot.taken = time.Now().Add(-minSnapshotAge)
+
+	checkRecords(t, "IXFR", transferRecords(t, n, "near.link.", 1000), []string{
+		"SOA 1005",
+		"SOA 1000",
+		"alice.near.link. A 192.0.2.1",
+		"SOA 1005",
+		"alice.near.link. A 192.0.2.2",
+		"SOA 1005",
+	})
+	ixfr := transferRecords(t, n, "near.link.", 990)
+	if len(ixfr) != len(expected) || ixfr[0] != "SOA 1005" || ixfr[len(ixfr)-1] != "SOA 1005" {
+		t.Errorf("IXFR from a serial outside the journal => %v (expected a full transfer)", ixfr)
+	}
+}
+
+// checkRecords compares transferred records with the expected ones.
+func checkRecords(t *testing.T, name string, records []string, expected []string) {
+	if len(records) != len(expected) {
+		t.Errorf("%s => %v (expected %v)", name, records, expected)
+		return
+	}
+	for i := range records {
+		if records[i] != expected[i] {
+			t.Errorf("%s record %d => %q (expected %q)", name, i, records[i], expected[i])
+		}
+	}
+}
+
+func TestTransferDelegation(t *testing.T) {
+	height := 1000
+	state := map[string]string{
+		"r" + string(borshString("erin:NS")):          "@ 300 IN NS ns1.erin.near.\n@ 300 IN NS ns.example.org.",
+		"r" + string(borshString("erin:DS")):          "@ 300 IN DS 12345 13 2 " + strings.Repeat("ab", 32),
+		"r" + string(borshString("erin:A:ns1")):       "ns1 300 IN A 192.0.2.10",
+		"r" + string(borshString("erin:A:www")):       "www 300 IN A 192.0.2.11",
+		"r" + string(borshString("erin:TXT")):         "@ 300 IN TXT \"not ours\"",
+		"r" + string(borshString("erin:contenthash")): testContentHash,
+		"r" + string(borshString("sub.erin:A")):       "@ 300 IN A 192.0.2.12",
+		"r" + string(borshString("sub.erin:NS")):      "@ 300 IN NS ns.sub.erin.near.",
+		"r" + string(borshString("frank:A")):          "@ 300 IN A 192.0.2.20",
+	}
+	server := contractStateServer(state, &height)
+	defer server.Close()
+
+	n := NEAR{
+		NEARDNS:             "dns.near",
+		NEARLinkNameServers: []string{"ns1.near.link."},
+		NameServerAddresses: map[string][]string{"ns1.near.link.": {"192.0.2.53"}},
+		IPFSGatewayAs:       []string{"192.0.2.80"},
+		Zone:                "near.link.",
+		ZoneTransfer:        NewZoneTransfer(server.URL, []byte("r")),
+	}
+
+	// Only the delegation of erin is transferred: its NS and DS records
+	// and the glue of its nameserver below the cut
+	checkRecords(t, "AXFR", transferRecords(t, n, "near.link.", 0), []string{
+		"SOA 1000",
+		"near.link. NS ns1.near.link.",
+		"ns1.near.link. A 192.0.2.53",
+		"erin.near.link. NS ns1.erin.near.link.",
+		"erin.near.link. NS ns.example.org.",
+		"erin.near.link. DS 12345 13 2 " + strings.Repeat("AB", 32),
+		"frank.near.link. A 192.0.2.20",
+		"ns1.erin.near.link. A 192.0.2.10",
+		"SOA 1000",
+	})
+}
@@ -0,0 +1,61 @@
+package near
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// zone returns the served zone, which is zoneApex unless another suffix
+// such as near.link. is configured.
+func (n NEAR) zone() string {
+	if n.Zone == "" {
+		return zoneApex
+	}
+	return n.Zone
+}
+
+// internalName maps a name in the served zone to the corresponding name
+// below zoneApex.  Other names are returned unchanged.
+func (n NEAR) internalName(name string) string {
+	zone := n.zone()
+	if zone == zoneApex || !dns.IsSubDomain(zone, name) {
+		return name
+	}
+	return strings.TrimSuffix(name, zone) + zoneApex
+}
+
+// externalName maps a name below zoneApex to the corresponding name in the
+// served zone.  Other names are returned unchanged.
+func (n NEAR) externalName(name string) string {
+	zone := n.zone()
+	if zone == zoneApex || !dns.IsSubDomain(zoneApex, name) {
+		return name
+	}
+	return strings.TrimSuffix(name, zoneApex) + zone
+}
+
+// externalNames maps the owner names of records, and the names in their
+// data, to the served zone.
+func (n NEAR) externalNames(rrs []dns.RR) {
+	for _, rr := range rrs {
+		rr.Header().Name = n.externalName(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			rr.Ns = n.externalName(rr.Ns)
+			rr.Mbox = n.externalName(rr.Mbox)
+		case *dns.NS:
+			rr.Ns = n.externalName(rr.Ns)
+		case *dns.CNAME:
+			rr.Target = n.externalName(rr.Target)
+		case *dns.DNAME:
+			rr.Target = n.externalName(rr.Target)
+		case *dns.MX:
+			rr.Mx = n.externalName(rr.Mx)
+		case *dns.SRV:
+			rr.Target = n.externalName(rr.Target)
+		case *dns.NSEC:
+			rr.NextDomain = n.externalName(rr.NextDomain)
+		}
+	}
+}